@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// AgendaResult は発表順が変わったことを参加者に通知するメッセージ
+type AgendaResult struct {
+	MessageType    string   `json:"messageType"`
+	MeetingId      int      `json:"meetingId"`
+	PresenterNames []string `json:"presenterNames"`
+	PresenterIds   []string `json:"presenterIds"`
+	DocumentIds    []int    `json:"documentIds"`
+}
+
+func newAgendaResult(db *gorm.DB, meetingId int) AgendaResult {
+	_, presenterNames, presenterIds, documentIds := getPresenters(db, meetingId)
+	return AgendaResult{
+		MessageType:    "agenda",
+		MeetingId:      meetingId,
+		PresenterNames: presenterNames,
+		PresenterIds:   presenterIds,
+		DocumentIds:    documentIds,
+	}
+}
+
+// sendAgenda は最新の発表順を参加者に通知する
+func (hub *Hub) sendAgenda(meetingId int) {
+	hub.broadcastToRoom(meetingId, newAgendaResult(db, meetingId))
+	fmt.Printf("Log: 発表順の通知を送信しました: %d in sendAgenda\n", meetingId)
+}
+
+// fixedPresenterCount は発表順を動かせない発表者の数を返す．
+// 進行中の会議では，次の発表者を発表中の発表者の発表順から決めるため，発表済みと発表中の発表者は動かせない．
+func fixedPresenterCount(db *gorm.DB, meetingId int) int {
+	state := getMeetingState(db, meetingId)
+	if state.State == MeetingStateScheduled || state.State == MeetingStateStarted || state.State == MeetingStateEnded || state.PresenterId == "" {
+		return 0
+	}
+	var participant Participant
+	if err := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, state.PresenterId).Error; err != nil || participant.ParticipantOrder == -1 {
+		return 0
+	}
+	return participant.ParticipantOrder + 1
+}
+
+// reorderPresenters は発表者の順番をpresenterIdsの順に並べ替える．
+// presenterIdsは現在の発表者全員をちょうど一度ずつ含む必要があり，発表済みと発表中の発表者の順番は変えられない．
+func reorderPresenters(db *gorm.DB, meetingId int, presenterIds []string) bool {
+	_, _, nowPresenterIds, _ := getPresenters(db, meetingId)
+	if len(presenterIds) != len(nowPresenterIds) {
+		fmt.Printf("Error: 発表者の人数が一致しません: %d, %s in reorderPresenters\n", meetingId, presenterIds)
+		return false
+	}
+	for i := 0; i < fixedPresenterCount(db, meetingId) && i < len(presenterIds); i++ {
+		if presenterIds[i] != nowPresenterIds[i] {
+			fmt.Printf("Error: 発表済みか発表中の発表者は並べ替えられません: %d, %s in reorderPresenters\n", meetingId, nowPresenterIds[i])
+			return false
+		}
+	}
+	isPresenter := make(map[string]bool)
+	for _, presenterId := range nowPresenterIds {
+		isPresenter[presenterId] = true
+	}
+	for _, presenterId := range presenterIds {
+		if !isPresenter[presenterId] {
+			fmt.Printf("Error: 発表者ではないか重複しています: %d, %s in reorderPresenters\n", meetingId, presenterId)
+			return false
+		}
+		delete(isPresenter, presenterId)
+	}
+	return setPresenters(db, meetingId, presenterIds)
+}
+
+// insertPresenter はpresenterIdを発表順のposition番目(0始まり)に入れる．
+// 既に発表者の場合はその位置に移動する．positionが範囲外の場合は最後に入れる．
+// 発表済みと発表中の発表者は動かせず，その前にも入れられない．
+func insertPresenter(db *gorm.DB, meetingId int, presenterId string, position int) bool {
+	_, _, nowPresenterIds, _ := getPresenters(db, meetingId)
+	fixedNum := fixedPresenterCount(db, meetingId)
+	if isFixedPresenter(nowPresenterIds, fixedNum, presenterId) || (position >= 0 && position < fixedNum) {
+		fmt.Printf("Error: 発表済みか発表中の発表者の前には入れられません: %d, %s, %d in insertPresenter\n", meetingId, presenterId, position)
+		return false
+	}
+	presenterIds := removePresenterId(nowPresenterIds, presenterId)
+	if position < 0 || position > len(presenterIds) {
+		position = len(presenterIds)
+	}
+	presenterIds = append(presenterIds[:position], append([]string{presenterId}, presenterIds[position:]...)...)
+	return setPresenters(db, meetingId, presenterIds)
+}
+
+// postponePresenter は発表者presenterIdを発表順の最後に回す
+func postponePresenter(db *gorm.DB, meetingId int, presenterId string) bool {
+	if !isPresenter(db, meetingId, presenterId) {
+		fmt.Printf("Error: 発表者ではありません: %d, %s in postponePresenter\n", meetingId, presenterId)
+		return false
+	}
+	_, _, nowPresenterIds, _ := getPresenters(db, meetingId)
+	if isFixedPresenter(nowPresenterIds, fixedPresenterCount(db, meetingId), presenterId) {
+		fmt.Printf("Error: 発表済みか発表中の発表者は最後に回せません: %d, %s in postponePresenter\n", meetingId, presenterId)
+		return false
+	}
+	return setPresenters(db, meetingId, append(removePresenterId(nowPresenterIds, presenterId), presenterId))
+}
+
+// isFixedPresenter はpresenterIdが発表順を動かせない先頭fixedNum人に含まれるかを返す
+func isFixedPresenter(presenterIds []string, fixedNum int, presenterId string) bool {
+	for i := 0; i < fixedNum && i < len(presenterIds); i++ {
+		if presenterIds[i] == presenterId {
+			return true
+		}
+	}
+	return false
+}
+
+func removePresenterId(presenterIds []string, presenterId string) []string {
+	removed := make([]string, 0, len(presenterIds))
+	for _, id := range presenterIds {
+		if id != presenterId {
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+const (
+	// アクセストークンの有効期間
+	accessTokenTTL = 1 * time.Hour
+
+	// リフレッシュトークンの有効期間
+	refreshTokenTTL = 7 * 24 * time.Hour
+
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+
+	// echo.Contextに認証済みのユーザーIDとセッションIDを格納するキー
+	contextUserIdKey    = "userId"
+	contextSessionIdKey = "sessionId"
+)
+
+// Session はログインごとに発行されるセッション．
+// ログアウトやリフレッシュ時にRevokedとなり，そのセッションのトークンは使えなくなる．
+type Session struct {
+	SessionId string `gorm:"primary_key"`
+	UserId    string
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// AuthClaims はアクセストークンとリフレッシュトークンに含めるクレーム．
+// Subjectにユーザー，IdにセッションIDを入れる．
+type AuthClaims struct {
+	TokenType string `json:"typ"`
+	jwt.StandardClaims
+}
+
+// Auth はJWTの発行と検証を行う
+type Auth struct {
+	db     *gorm.DB
+	secret []byte
+}
+
+func newAuth(db *gorm.DB) *Auth {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		fmt.Println("Warning: $JWT_SECRET が未設定のため，起動ごとに署名鍵を生成します")
+		secret = randomHex(32)
+	}
+	return &Auth{db: db, secret: []byte(secret)}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// issueTokens はuserIdの新しいセッションを作成し，アクセストークンとリフレッシュトークンを返す
+func (a *Auth) issueTokens(userId string) (bool, string, string) {
+	now := time.Now()
+	session := Session{
+		SessionId: randomHex(16),
+		UserId:    userId,
+		ExpiresAt: now.Add(refreshTokenTTL),
+		Revoked:   false,
+	}
+	if err := a.db.Create(&session).Error; err != nil {
+		fmt.Printf("Error: create失敗(セッションの登録に失敗しました): %s in issueTokens\n", userId)
+		return false, "", ""
+	}
+	// 期限切れのセッションを掃除
+	a.db.Delete(&Session{}, "expires_at < ?", now)
+
+	accessToken, accessErr := a.sign(accessTokenType, session, now.Add(accessTokenTTL))
+	refreshToken, refreshErr := a.sign(refreshTokenType, session, session.ExpiresAt)
+	if accessErr != nil || refreshErr != nil {
+		fmt.Printf("Error: トークンの署名に失敗しました: %s in issueTokens\n", userId)
+		return false, "", ""
+	}
+	fmt.Printf("Log: トークンを発行しました: %s in issueTokens\n", userId)
+	return true, accessToken, refreshToken
+}
+
+func (a *Auth) sign(tokenType string, session Session, expiresAt time.Time) (string, error) {
+	claims := AuthClaims{
+		TokenType: tokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.SessionId,
+			Subject:   session.UserId,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+}
+
+// verify はトークンの署名・有効期限・種別とセッションの有効性を検証し，ユーザーIDとセッションIDを返す
+func (a *Auth) verify(tokenString string, tokenType string) (bool, string, string) {
+	claims := &AuthClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return a.secret, nil
+	})
+	if err != nil || !token.Valid || claims.TokenType != tokenType {
+		fmt.Printf("Error: トークンが不正です: %s in verify\n", tokenType)
+		return false, "", ""
+	}
+
+	var session Session
+	if err := a.db.First(&session, "session_id = ? AND user_id = ?", claims.Id, claims.Subject).Error; err != nil || session.Revoked {
+		fmt.Printf("Error: セッションが無効です: %s in verify\n", claims.Subject)
+		return false, "", ""
+	}
+	return true, claims.Subject, claims.Id
+}
+
+// refresh はリフレッシュトークンを検証し，古いセッションを無効にして新しいトークンを発行する
+func (a *Auth) refresh(refreshToken string) (bool, string, string) {
+	isValid, userId, sessionId := a.verify(refreshToken, refreshTokenType)
+	if !isValid {
+		return false, "", ""
+	}
+	if !a.revoke(sessionId) {
+		return false, "", ""
+	}
+	return a.issueTokens(userId)
+}
+
+// revoke はセッションを無効にする
+func (a *Auth) revoke(sessionId string) bool {
+	if err := a.db.Model(&Session{}).Where("session_id = ?", sessionId).Update("revoked", true).Error; err != nil {
+		fmt.Printf("Error: update失敗(セッションの無効化に失敗しました): %s in revoke\n", sessionId)
+		return false
+	}
+	return true
+}
+
+// requireAuth はアクセストークンを検証し，呼び出し元のユーザーIDをecho.Contextに格納するミドルウェア．
+// トークンはAuthorizationヘッダ(Bearer)で渡す．ヘッダを付けられないWeb Socketの接続ではクエリパラメータのtokenでもよい．
+func (a *Auth) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tokenString := c.QueryParam("token")
+		if header := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(header, "Bearer ") {
+			tokenString = strings.TrimPrefix(header, "Bearer ")
+		}
+		isValid, userId, sessionId := a.verify(tokenString, accessTokenType)
+		if !isValid {
+			return c.JSON(http.StatusUnauthorized, &Result{Result: false})
+		}
+		c.Set(contextUserIdKey, userId)
+		c.Set(contextSessionIdKey, sessionId)
+		return next(c)
+	}
+}
+
+// contextUserId はrequireAuthで認証された呼び出し元のユーザーIDを返す
+func contextUserId(c echo.Context) string {
+	userId, _ := c.Get(contextUserIdKey).(string)
+	return userId
+}
+
+// contextSessionId はrequireAuthで認証された呼び出し元のセッションIDを返す
+func contextSessionId(c echo.Context) string {
+	sessionId, _ := c.Get(contextSessionIdKey).(string)
+	return sessionId
+}
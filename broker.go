@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Broker は会議へのメッセージを全てのノードのHubに配信する．
+// 複数のプロセスで動かす場合も，会議ごとの通し番号はBrokerが全体で一意に振る．
+type Broker interface {
+	// Publish はmessageを配信する．一時的でないメッセージにはSeqを振る
+	Publish(message *RoomMessage) error
+	// Subscribe は配信されたメッセージを，配信された順にdeliverに渡す
+	Subscribe(deliver func(message *RoomMessage)) error
+}
+
+// newBroker は$REDIS_URLが設定されていればRedisを，なければプロセス内のBrokerを使う
+func newBroker() Broker {
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		fmt.Println("Log: Redisでメッセージを配信します in newBroker")
+		return newRedisBroker(url)
+	}
+	return newMemoryBroker()
+}
+
+// memoryBroker は1プロセスのみで動かす場合のBroker．
+// Publishは通し番号を振って待ち行列に入れるのみで，配信は1つのゴルーチンが通し番号の順に行う．
+// 配信先(Hubのrun)の受信を待つ間にロックを持たないため，Publishの呼び出し元を止めない．
+type memoryBroker struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	seqs        map[int]int64
+	queue       []*RoomMessage
+	subscribers []func(message *RoomMessage)
+}
+
+func newMemoryBroker() *memoryBroker {
+	b := &memoryBroker{seqs: make(map[int]int64)}
+	b.cond = sync.NewCond(&b.mu)
+	go b.deliverLoop()
+	return b
+}
+
+func (b *memoryBroker) Publish(message *RoomMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !message.IsEphemeral {
+		b.seqs[message.MeetingId] += 1
+		message.Seq = b.seqs[message.MeetingId]
+	}
+	b.queue = append(b.queue, message)
+	b.cond.Signal()
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(deliver func(message *RoomMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers = append(b.subscribers, deliver)
+	return nil
+}
+
+// deliverLoop は待ち行列のメッセージを，ロックを解放してから購読者に配信する
+func (b *memoryBroker) deliverLoop() {
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 {
+			b.cond.Wait()
+		}
+		messages := b.queue
+		b.queue = nil
+		subscribers := append([]func(message *RoomMessage){}, b.subscribers...)
+		b.mu.Unlock()
+
+		for _, message := range messages {
+			for _, deliver := range subscribers {
+				// Hubは受け取ったメッセージに通し番号を書き込むため，購読者ごとに複製して渡す
+				copied := *message
+				deliver(&copied)
+			}
+		}
+	}
+}
+
+const (
+	redisRoomChannel = "rochup:room"   // 全ての会議のメッセージを配信するチャネル
+	redisSeqKey      = "rochup:seq:%d" // 会議ごとの通し番号
+	redisRetryWait   = 1 * time.Second // 購読が切れた時に再接続するまでの時間
+)
+
+// redisPublishScript は通し番号を振って配信する．
+// スクリプトは不可分に実行されるため，通し番号の順に配信される．
+var redisPublishScript = redis.NewScript(1, `
+local seq = 0
+if ARGV[2] == "0" then
+	seq = redis.call("INCR", KEYS[1])
+end
+redis.call("PUBLISH", ARGV[3], seq .. " " .. ARGV[1])
+return seq
+`)
+
+// redisBroker はRedisのPub/Subで複数のプロセスに配信するBroker
+type redisBroker struct {
+	pool *redis.Pool
+}
+
+func newRedisBroker(url string) *redisBroker {
+	return &redisBroker{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(url)
+			},
+		},
+	}
+}
+
+func (b *redisBroker) Publish(message *RoomMessage) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	isEphemeral := "0"
+	if message.IsEphemeral {
+		isEphemeral = "1"
+	}
+	seq, err := redis.Int64(redisPublishScript.Do(conn, fmt.Sprintf(redisSeqKey, message.MeetingId), payload, isEphemeral, redisRoomChannel))
+	if err != nil {
+		fmt.Printf("Error: Redisへの配信に失敗しました: %d, %s in Publish\n", message.MeetingId, err)
+		return err
+	}
+	message.Seq = seq
+	return nil
+}
+
+// Subscribe は購読用の接続を張り，切れた場合は張り直す
+func (b *redisBroker) Subscribe(deliver func(message *RoomMessage)) error {
+	go func() {
+		for {
+			if err := b.receive(deliver); err != nil {
+				fmt.Printf("Error: Redisの購読が切れました: %s in Subscribe\n", err)
+			}
+			time.Sleep(redisRetryWait)
+		}
+	}()
+	return nil
+}
+
+func (b *redisBroker) receive(deliver func(message *RoomMessage)) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(redisRoomChannel); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			message, ok := decodeRedisMessage(v.Data)
+			if !ok {
+				fmt.Printf("Error: Redisから不正なメッセージを受け取りました in receive\n")
+				continue
+			}
+			deliver(message)
+		case error:
+			return v
+		}
+	}
+}
+
+// decodeRedisMessage は"通し番号 JSON"の形式のメッセージを読み込む
+func decodeRedisMessage(data []byte) (*RoomMessage, bool) {
+	parts := strings.SplitN(string(data), " ", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	message := new(RoomMessage)
+	if err := json.Unmarshal([]byte(parts[1]), message); err != nil {
+		return nil, false
+	}
+	message.Seq = seq
+	return message, true
+}
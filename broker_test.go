@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// brokerPair は2つのノードのHubがそれぞれ使うBroker
+type brokerPair struct {
+	name  string
+	setup func(t *testing.T) (Broker, Broker)
+}
+
+var brokerPairs = []brokerPair{
+	{"memory", func(t *testing.T) (Broker, Broker) {
+		// 1プロセスの場合は同じBrokerを共有する
+		broker := newMemoryBroker()
+		return broker, broker
+	}},
+	{"redis", func(t *testing.T) (Broker, Broker) {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatalf("miniredisを起動できません: %v", err)
+		}
+		t.Cleanup(server.Close)
+		url := "redis://" + server.Addr()
+		return newRedisBroker(url), newRedisBroker(url)
+	}},
+}
+
+// startHubs は2つのBrokerでそれぞれHubを動かし，会議meetingIdのclientを1つずつ登録する
+func startHubs(t *testing.T, first Broker, second Broker, meetingId int) (*Client, *Client) {
+	clients := make([]*Client, 0, 2)
+	for _, broker := range []Broker{first, second} {
+		hub := newHub(newFakeClock(time.Now()), broker)
+		go hub.run()
+		// 最後の通し番号(0)を指定して登録し，最新の状態(DBが必要)ではなく再送の経路を通す
+		client := &Client{hub: hub, send: make(chan []byte, 256), meetingId: meetingId, userId: "user", lastSeq: 0}
+		hub.register <- client
+		clients = append(clients, client)
+	}
+	return clients[0], clients[1]
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("待機がタイムアウトしました")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receiveSeq はclientが受け取ったメッセージの通し番号を返す．通し番号がない場合は-1
+func receiveSeq(t *testing.T, client *Client) int64 {
+	select {
+	case data := <-client.send:
+		if seq, ok := seqOf(data); ok {
+			return seq
+		}
+		return -1
+	case <-time.After(2 * time.Second):
+		t.Fatalf("メッセージが届きません")
+		return -1
+	}
+}
+
+// waitSubscribed はredisの場合に，2つ目のBrokerの購読が始まるまで待つ
+func waitSubscribed(t *testing.T, first *Client, second *Client) {
+	// 購読前に配信されたメッセージは届かないため，両方に届くまで一時的なメッセージを送り直す
+	waitFor(t, func() bool {
+		first.hub.broadcastEphemeral(first.meetingId, Message{MessageType: "message", Message: "ping"})
+		select {
+		case <-second.send:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	})
+	for drained := false; !drained; {
+		select {
+		case <-first.send:
+		case <-second.send:
+		case <-time.After(100 * time.Millisecond):
+			drained = true
+		}
+	}
+}
+
+func TestBrokerDeliversAcrossHubs(t *testing.T) {
+	for _, pair := range brokerPairs {
+		t.Run(pair.name, func(t *testing.T) {
+			first, second := pair.setup(t)
+			a, b := startHubs(t, first, second, 1)
+			waitSubscribed(t, a, b)
+
+			a.hub.broadcastToRoom(1, Message{MessageType: "message", Message: "hello"})
+			if got := receiveSeq(t, a); got != 1 {
+				t.Errorf("送信元のノードの通し番号 = %d, want 1", got)
+			}
+			if got := receiveSeq(t, b); got != 1 {
+				t.Errorf("他のノードの通し番号 = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestBrokerSeqPerMeeting(t *testing.T) {
+	for _, pair := range brokerPairs {
+		t.Run(pair.name, func(t *testing.T) {
+			first, second := pair.setup(t)
+			a1, b1 := startHubs(t, first, second, 1)
+			a2, b2 := startHubs(t, first, second, 2)
+			waitSubscribed(t, a1, b1)
+			waitSubscribed(t, a2, b2)
+
+			a1.hub.broadcastToRoom(1, Message{MessageType: "message", Message: "1-1"})
+			b2.hub.broadcastToRoom(2, Message{MessageType: "message", Message: "2-1"})
+			b1.hub.broadcastToRoom(1, Message{MessageType: "message", Message: "1-2"})
+
+			for _, client := range []*Client{a1, b1} {
+				for _, want := range []int64{1, 2} {
+					if got := receiveSeq(t, client); got != want {
+						t.Errorf("会議1の通し番号 = %d, want %d", got, want)
+					}
+				}
+			}
+			for _, client := range []*Client{a2, b2} {
+				if got := receiveSeq(t, client); got != 1 {
+					t.Errorf("会議2の通し番号 = %d, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestBrokerEphemeral(t *testing.T) {
+	for _, pair := range brokerPairs {
+		t.Run(pair.name, func(t *testing.T) {
+			first, second := pair.setup(t)
+			a, b := startHubs(t, first, second, 1)
+			waitSubscribed(t, a, b)
+
+			a.hub.broadcastEphemeral(1, CountdownMsg{MessageType: "countdown", MeetingId: 1, RemainingSec: 60})
+			a.hub.broadcastToRoom(1, Message{MessageType: "message", Message: "hello"})
+
+			for _, client := range []*Client{a, b} {
+				if got := receiveSeq(t, client); got != -1 {
+					t.Errorf("一時的なメッセージの通し番号 = %d, want なし", got)
+				}
+				// 一時的なメッセージは通し番号を消費しない
+				if got := receiveSeq(t, client); got != 1 {
+					t.Errorf("続くメッセージの通し番号 = %d, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestAckAfterBroadcast(t *testing.T) {
+	for _, pair := range brokerPairs {
+		t.Run(pair.name, func(t *testing.T) {
+			first, second := pair.setup(t)
+			a, b := startHubs(t, first, second, 1)
+			waitSubscribed(t, a, b)
+
+			// 配信されるメッセージより先にackが届いても，メッセージの後に送る
+			a.hub.sendToClientAfter(a, AckResult{MessageType: "ack", RequestId: "1"}, 1)
+			a.hub.broadcastToRoom(1, Message{MessageType: "message", Message: "hello"})
+
+			for _, want := range []string{"message", "ack"} {
+				select {
+				case data := <-a.send:
+					var envelope Envelope
+					if err := json.Unmarshal(data, &envelope); err != nil {
+						t.Fatalf("JSONとして読み込めません: %s", data)
+					}
+					if envelope.MessageType != want {
+						t.Errorf("messageType = %s, want %s", envelope.MessageType, want)
+					}
+					if seq, _ := seqOf(data); seq != 1 {
+						t.Errorf("%sの通し番号 = %d, want 1", want, seq)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("メッセージが届きません")
+				}
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -26,13 +27,13 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// 最大長の質問本文(maxQuestionBodyLength文字，UTF-8で1文字最大4バイト)に他の項目を加えても収まる大きさにする
+	maxMessageSize = 8 * 1024
 )
 
 var (
-	newline    = []byte{'\n'}
-	space      = []byte{' '}
-	isReserved = map[int]bool{} // 会議開始の司会メッセージを通知予約したか
+	newline = []byte{'\n'}
+	space   = []byte{' '}
 )
 
 var (
@@ -61,6 +62,11 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte // broadcastのメッセージを受け取るチャネル
+
+	meetingId int    // 接続先の会議ID
+	userId    string // 接続したユーザーのID
+	lastSeq   int64  // 再接続時に最後に受け取っていたメッセージの通し番号(初回の接続は-1)
+	isSyncing bool   // 最新の状態を作っている間は配信を保留する．Hubのrunのみが読み書きする
 }
 
 type Message struct {
@@ -79,14 +85,17 @@ type DocumentUpdateResult struct {
 }
 
 type QuestionResult struct {
-	MessageType  string `json:"messageType"`
-	QuestionId   int    `json:"questionId"`
-	MeetingId    int    `json:"meetingId"`
-	QuestionBody string `json:"questionBody"`
-	DocumentId   int    `json:"documentId"`
-	DocumentPage int    `json:"documentPage"`
-	QuestionTime string `json:"questionTime"`
-	PresenterId  string `json:"presenterId"`
+	MessageType  string            `json:"messageType"`
+	QuestionId   int               `json:"questionId"`
+	MeetingId    int               `json:"meetingId"`
+	UserId       string            `json:"userId"` // 匿名質問を許可している場合は空
+	QuestionBody string            `json:"questionBody"`
+	DocumentId   int               `json:"documentId"`
+	DocumentPage int               `json:"documentPage"`
+	QuestionTime string            `json:"questionTime"`
+	PresenterId  string            `json:"presenterId"`
+	ClusterId    int               `json:"clusterId"`        // 似た質問と自動でまとめた場合のまとまりのID．まとめていない場合は-1
+	Similars     []SimilarQuestion `json:"similarQuestions"` // 似ている未回答の質問(統合の候補)
 }
 
 type QuestionVoteResult struct {
@@ -97,9 +106,12 @@ type QuestionVoteResult struct {
 }
 
 type HandsUpResult struct {
-	MessageType string `json:"messageType"`
-	MeetingId   int    `json:"meetingId"`
-	UserId      string `json:"userId"`
+	MessageType  string   `json:"messageType"`
+	MeetingId    int      `json:"meetingId"`
+	UserId       string   `json:"userId"`
+	DocumentId   int      `json:"documentId"`
+	Position     int      `json:"position"`     // 待ち行列での順番(1から)．手を下ろした場合は0
+	QueueUserIds []string `json:"queueUserIds"` // 挙手の待ち行列(当てられる順)
 }
 
 type ReactionResult struct {
@@ -120,14 +132,51 @@ type ModeratorMsg struct {
 	PresentOrder     int    `json:"presentOrder"` // only if `IsStartPresen == true`, else = -1
 }
 
-var questionCount = make(map[int]int)
-
-const maxQuestionNum = 5
+// messageRoles はWeb Socketのメッセージ種別ごとに送信できる参加者の役割
+var messageRoles = map[string][]string{
+	"message":           {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator},
+	"question":          {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator},
+	"question_vote":     {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator},
+	"handsup":           {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator},
+	"reaction":          {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator},
+	"finishword":        {RoleOrganizer, RolePresenter, RoleModerator}, // 発表者は本人の発表のみ(canFinishPresenで確認)
+	"agenda_reorder":    {RoleOrganizer, RoleModerator},
+	"agenda_insert":     {RoleOrganizer, RoleModerator},
+	"agenda_postpone":   {RoleOrganizer, RoleModerator},
+	"hands_reorder":     {RoleOrganizer, RoleModerator},
+	"hands_clear":       {RoleOrganizer, RoleModerator},
+	"question_edit":     {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator}, // 質問者本人のみ(handleQuestionEditで確認)
+	"question_withdraw": {RoleOrganizer, RolePresenter, RoleAudience, RoleModerator}, // 質問者本人のみ(handleQuestionWithdrawで確認)
+	"question_dismiss":  {RoleOrganizer, RolePresenter, RoleModerator},               // 発表者は本人への質問のみ(canModerateQuestionで確認)
+	"question_answered": {RoleOrganizer, RolePresenter, RoleModerator},
+	"question_merge":    {RoleOrganizer, RolePresenter, RoleModerator},
+	"question_approve":  {RoleOrganizer, RoleModerator},
+	"question_reject":   {RoleOrganizer, RoleModerator},
+}
 
-func loadJson(byteArray []byte) (interface{}, error) {
-	var jsonObj interface{}
-	err := json.Unmarshal(byteArray, &jsonObj)
-	return jsonObj, err
+// messageHandler はメッセージを処理し，同じ会議に送信するメッセージを返す
+type messageHandler func(c *Client, data []byte) (interface{}, *ProtocolError)
+
+// messageHandlers はWeb Socketのメッセージ種別ごとの処理
+var messageHandlers = map[string]messageHandler{
+	"message":           (*Client).handleMessage,
+	"question":          (*Client).handleQuestion,
+	"question_vote":     (*Client).handleQuestionVote,
+	"handsup":           (*Client).handleHandsUp,
+	"reaction":          (*Client).handleReaction,
+	"finishword":        (*Client).handleFinishWord,
+	"agenda_reorder":    (*Client).handleAgendaReorder,
+	"agenda_insert":     (*Client).handleAgendaInsert,
+	"agenda_postpone":   (*Client).handleAgendaPostpone,
+	"hands_reorder":     (*Client).handleHandsReorder,
+	"hands_clear":       (*Client).handleHandsClear,
+	"question_edit":     (*Client).handleQuestionEdit,
+	"question_withdraw": (*Client).handleQuestionWithdraw,
+	"question_dismiss":  (*Client).handleQuestionDismiss,
+	"question_answered": (*Client).handleQuestionAnswered,
+	"question_merge":    (*Client).handleQuestionMerge,
+	"question_approve":  (*Client).handleQuestionApprove,
+	"question_reject":   (*Client).handleQuestionReject,
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -154,206 +203,547 @@ func (c *Client) readPump() {
 			}
 			break
 		}
+		fmt.Printf("Log: Receive: " + string(message) + " in readPump\n")
 
 		// websocketで受け取ったデータの処理
-		jsonObj, jsonerr := loadJson(message)
-		if jsonerr != nil {
-			fmt.Printf("Error: loadJsonでエラーが発生しました in readPump\n")
+		var envelope Envelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
+			c.sendError(envelope, newProtocolError(ErrorCodeInvalidJson, "JSONとして読み込めません"))
+			continue
+		}
+		messagestruct, perr := c.handle(envelope, message)
+		if perr != nil {
+			c.sendError(envelope, perr)
 			continue
 		}
-		fmt.Printf("Log: Receive: " + string(message) + " in readPump\n")
-		message_type := jsonObj.(map[string]interface{})["messageType"].(string)
-
-		var messagestruct interface{}
-
-		switch message_type {
-		case "message":
-			message_jsonobj := jsonObj.(map[string]interface{})["message"].(string)
-			messagestruct = Message{MessageType: "message", Message: message_jsonobj}
-		case "question":
-			var (
-				layout      = "2006/01/02 15:04:05"
-				location, _ = time.LoadLocation("Asia/Tokyo")
-			)
-
-			userId := jsonObj.(map[string]interface{})["userId"].(string)
-			meetingId := int(jsonObj.(map[string]interface{})["meetingId"].(float64))
-			questionBody := jsonObj.(map[string]interface{})["questionBody"].(string)
-			documentId := int(jsonObj.(map[string]interface{})["documentId"].(float64))
-			documentPage := int(jsonObj.(map[string]interface{})["documentPage"].(float64))
-			questionTimeStr := jsonObj.(map[string]interface{})["questionTime"].(string)
-
-			questionTime, _ := time.ParseInLocation(layout, questionTimeStr, location)
-			question := Question{
-				UserId:       userId,
-				QuestionBody: questionBody,
-				DocumentId:   documentId,
-				DocumentPage: documentPage,
-				VoteNum:      0,
-				QuestionTime: questionTime,
-				IsVoice:      false,
-			}
 
-			isCreateQuestionOK, questionId := createQuestion(db, question)
+		// 自分のメッセージを同じ会議のclientに向けてhubのbroadcastチャネルに送り込む
+		fmt.Printf("Log: Send: %+v in readPump\n", messagestruct)
+		seq := c.hub.broadcastToRoom(c.meetingId, messagestruct)
+		if envelope.RequestId != "" {
+			// ackは会議に送信したメッセージの後に，そのメッセージの通し番号を付けて送る
+			c.hub.sendToClientAfter(c, AckResult{
+				MessageType:        "ack",
+				RequestId:          envelope.RequestId,
+				RequestMessageType: envelope.MessageType,
+				Data:               messagestruct,
+			}, seq)
+		}
+	}
+}
 
-			if !isCreateQuestionOK {
-				return
-			}
+// handle は読み込んだenvelopeのversionを確認し，種別ごとの処理を呼び出す
+func (c *Client) handle(envelope Envelope, message []byte) (interface{}, *ProtocolError) {
+	if envelope.Version != 0 && envelope.Version != protocolVersion {
+		return nil, newProtocolError(ErrorCodeUnsupportedVersion, "対応していないversionです: %d", envelope.Version)
+	}
+	return c.dispatch(envelope.MessageType, message)
+}
 
-			presenterId := getPresenterId(db, documentId)
-
-			messagestruct = QuestionResult{
-				MessageType:  message_type,
-				QuestionId:   questionId,
-				MeetingId:    meetingId,
-				QuestionBody: questionBody,
-				DocumentId:   documentId,
-				DocumentPage: documentPage,
-				QuestionTime: questionTimeStr,
-				PresenterId:  presenterId,
-			}
-		case "question_vote":
-			questionId := int(jsonObj.(map[string]interface{})["questionId"].(float64))
-			isVote := jsonObj.(map[string]interface{})["isVote"].(bool)
+// dispatch は権限を確認し，messageTypeの処理を呼び出す．RESTからも呼び出される
+func (c *Client) dispatch(messageType string, message []byte) (interface{}, *ProtocolError) {
+	handler, ok := messageHandlers[messageType]
+	if !ok {
+		return nil, newProtocolError(ErrorCodeUnknownMessageType, "未知のmessageTypeです: %s", messageType)
+	}
+	if roles, ok := messageRoles[messageType]; ok && !hasRole(db, c.meetingId, c.userId, roles...) {
+		fmt.Printf("Error: メッセージを送信する権限がありません: %s, %s in dispatch\n", messageType, c.userId)
+		return nil, newProtocolError(ErrorCodeForbidden, "%sを送信する権限がありません", messageType)
+	}
+	return handler(c, message)
+}
 
-			meetingId, questionId, voteNum := voteQuestion(db, questionId, isVote)
+// sendError は処理できなかったメッセージの送信者にのみエラーを返す
+func (c *Client) sendError(envelope Envelope, perr *ProtocolError) {
+	fmt.Printf("Error: メッセージを処理できませんでした: %s, %s, %s in sendError\n", envelope.MessageType, perr.Code, perr.Message)
+	c.hub.sendToClient(c, ErrorResult{
+		MessageType:        "error",
+		RequestId:          envelope.RequestId,
+		Code:               perr.Code,
+		Message:            perr.Message,
+		RequestMessageType: envelope.MessageType,
+	})
+}
 
-			messagestruct = QuestionVoteResult{
-				MessageType: message_type,
-				MeetingId:   meetingId,
-				QuestionId:  questionId,
-				VoteNum:     voteNum,
-			}
-		case "handsup":
-			userId := jsonObj.(map[string]interface{})["userId"].(string)
-			documentId := int(jsonObj.(map[string]interface{})["documentId"].(float64))
-			documentPage := int(jsonObj.(map[string]interface{})["documentPage"].(float64))
-			isUp := jsonObj.(map[string]interface{})["isUp"].(bool)
-
-			var meetingId int
-
-			if isUp {
-				meetingId = handsUp(db, userId, documentId, documentPage)
-			} else {
-				meetingId = handsDown(db, userId, documentId, documentPage)
-			}
+func (c *Client) handleMessage(data []byte) (interface{}, *ProtocolError) {
+	request := new(MessageMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	return Message{MessageType: "message", Message: request.Message}, nil
+}
 
-			messagestruct = HandsUpResult{
-				MessageType: message_type,
-				MeetingId:   meetingId,
-				UserId:      userId,
-			}
-		case "reaction":
-			documentId := int(jsonObj.(map[string]interface{})["documentId"].(float64))
-			documentPage := int(jsonObj.(map[string]interface{})["documentPage"].(float64))
-			isReaction := jsonObj.(map[string]interface{})["isReaction"].(bool)
-
-			var (
-				meetingId   int
-				reactionNum int
-			)
-
-			meetingId, reactionNum = voteReaction(db, documentId, documentPage, isReaction)
-
-			messagestruct = ReactionResult{
-				MessageType:  message_type,
-				MeetingId:    meetingId,
-				DocumentId:   documentId,
-				DocumentPage: documentPage,
-				ReactionNum:  reactionNum,
-			}
-		case "finishword":
-			meetingId := int(jsonObj.(map[string]interface{})["meetingId"].(float64))
-			presenterId := jsonObj.(map[string]interface{})["presenterId"].(string)
-			finishType := jsonObj.(map[string]interface{})["finishType"].(string)
-
-			var (
-				moderatorMsgBody string
-				questionId       int
-				questionUserId   string
-				isStartPresen    = false
-				nextOrder        = -1
-			)
-			// 規定の質問数に達した場合
-			if questionCount[meetingId] >= maxQuestionNum {
-				var (
-					endPresen  bool
-					nextUserId string
-				)
-				endPresen, nextUserId, nextOrder = getNextPresenterId(db, meetingId, presenterId)
-				if !endPresen {
-					moderatorMsgBody = personEnd(presenterId, nextUserId, meetingId)
-					isStartPresen = true
-					questionId = -1
-					questionUserId = ""
-				} else {
-					moderatorMsgBody = meetingEnd()
-					questionId = -1
-					questionUserId = ""
-				}
-				questionCount[meetingId] = 0
-			} else {
-				switch finishType {
-				case "present":
-					moderatorMsgBody, questionUserId, questionId = presenOrQuestionEnd(db, meetingId, presenterId, true, "")
-				case "question":
-					questionUserId = jsonObj.(map[string]interface{})["questionUserId"].(string)
-					moderatorMsgBody, questionUserId, questionId = presenOrQuestionEnd(db, meetingId, presenterId, false, questionUserId)
-				default:
-					fmt.Printf("Error: 予期せぬfinishType: %s in readPump\n", finishType)
-					continue
-				}
-				if questionCount[meetingId] == 0 {
-					questionCount[meetingId] = 1
-				} else {
-					questionCount[meetingId] += 1
-				}
-				fmt.Printf("Log: 現在の質問数：%d in readPump\n", questionCount[meetingId])
-			}
+func (c *Client) handleQuestion(data []byte) (interface{}, *ProtocolError) {
+	var (
+		layout      = "2006/01/02 15:04:05"
+		location, _ = time.LoadLocation("Asia/Tokyo")
+	)
+	request := new(QuestionMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !c.isOwnIdentity("question", request.UserId, request.MeetingId) || !c.isOwnIdentity("question", request.UserId, getDocumentMeetingId(db, request.DocumentId)) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の参加者や会議の質問は投稿できません")
+	}
 
-			messagestruct = ModeratorMsg{
-				MessageType:      ModeratorMsgType,
-				MeetingId:        meetingId,
-				ModeratorMsgBody: moderatorMsgBody,
-				IsStartPresen:    isStartPresen,
-				QuestionId:       questionId,
-				QuestionUserId:   questionUserId,
-				PresentOrder:     nextOrder,
-			}
-		default:
-			continue
+	setting := getMeetingSetting(db, request.MeetingId)
+	questionTime, _ := time.ParseInLocation(layout, request.QuestionTime, location)
+	question := Question{
+		UserId:       request.UserId,
+		QuestionBody: request.QuestionBody,
+		DocumentId:   request.DocumentId,
+		DocumentPage: request.DocumentPage,
+		VoteNum:      0,
+		QuestionTime: questionTime,
+		IsVoice:      false,
+		Status:       QuestionStatusOpen,
+	}
+	// 承認制の場合は承認されるまで公開せず，質問の候補からも外す
+	if setting.QuestionApprovalRequired {
+		question.Status = QuestionStatusPending
+		question.QuestionOk = true
+	}
+
+	isCreateQuestionOK, questionId := createQuestion(db, question)
+	if !isCreateQuestionOK {
+		return nil, newProtocolError(ErrorCodeFailed, "質問の登録に失敗しました")
+	}
+	question.QuestionId = questionId
+
+	if setting.QuestionApprovalRequired {
+		return newPendingQuestionMessage(request.MeetingId, question, setting), nil
+	}
+	return c.publishQuestion(question, setting), nil
+}
+
+// newPendingQuestionMessage は承認待ちの質問の通知を作る．主催者，共同司会者と質問者本人にのみ通知する
+func newPendingQuestionMessage(meetingId int, question Question, setting MeetingSetting) RestrictedMessage {
+	result := newQuestionResult(meetingId, question, setting)
+	result.MessageType = "question_pending"
+	result.Similars = findSimilarQuestions(db, question)
+	return RestrictedMessage{
+		UserIds: append(getModeratorUserIds(db, meetingId), question.UserId),
+		Message: result,
+	}
+}
+
+// publishQuestion は公開する質問の通知を作る．似ている質問を探し，十分に似ていれば同じまとまりにする
+func (c *Client) publishQuestion(question Question, setting MeetingSetting) QuestionResult {
+	result := newQuestionResult(c.meetingId, question, setting)
+	result.Similars = findSimilarQuestions(db, question)
+	if len(result.Similars) != 0 && result.Similars[0].Similarity >= duplicateGroupThreshold {
+		if ok, clusterId := groupQuestion(db, question.QuestionId, result.Similars[0].QuestionId); ok {
+			result.ClusterId = clusterId
 		}
-		messagejson, _ := json.Marshal(messagestruct)
+	}
+	return result
+}
 
-		// 自分のメッセージをhubのbroadcastチャネルに送り込む
-		fmt.Printf("Log: Send: %+v in readPump\n", messagestruct)
-		c.hub.broadcast <- messagejson
+func newQuestionResult(meetingId int, question Question, setting MeetingSetting) QuestionResult {
+	var (
+		layout      = "2006/01/02 15:04:05"
+		location, _ = time.LoadLocation("Asia/Tokyo")
+	)
+	questionUserId := ""
+	if !setting.AnonymousQuestionAllowed {
+		questionUserId = question.UserId
+	}
+
+	return QuestionResult{
+		MessageType:  "question",
+		QuestionId:   question.QuestionId,
+		MeetingId:    meetingId,
+		UserId:       questionUserId,
+		QuestionBody: question.QuestionBody,
+		DocumentId:   question.DocumentId,
+		DocumentPage: question.DocumentPage,
+		QuestionTime: question.QuestionTime.In(location).Format(layout),
+		PresenterId:  getPresenterId(db, question.DocumentId),
+		ClusterId:    clusterIdOrNone(question),
+		Similars:     []SimilarQuestion{},
 	}
 }
 
-func (hub *Hub) sendStartMeetingMessage(meetingId int, startTime time.Time) {
-	location, _ := time.LoadLocation("Asia/Tokyo")
+func (c *Client) handleQuestionApprove(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionReviewMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if getDocumentMeetingId(db, question.DocumentId) != c.meetingId {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の質問は承認できません")
+	}
+	if questionStatus(question) != QuestionStatusPending {
+		return nil, newProtocolError(ErrorCodeInvalidState, "承認待ちの質問ではありません: %d", request.QuestionId)
+	}
+
+	if !approveQuestion(db, request.QuestionId) {
+		return nil, newProtocolError(ErrorCodeFailed, "質問の承認に失敗しました")
+	}
+	question.Status = QuestionStatusOpen
+	question.QuestionOk = false
+	return c.publishQuestion(question, getMeetingSetting(db, c.meetingId)), nil
+}
+
+func (c *Client) handleQuestionReject(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionReviewMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if getDocumentMeetingId(db, question.DocumentId) != c.meetingId {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の質問は取り下げられません")
+	}
+	if questionStatus(question) != QuestionStatusPending {
+		return nil, newProtocolError(ErrorCodeInvalidState, "承認待ちの質問ではありません: %d", request.QuestionId)
+	}
+
+	return c.closePendingQuestion(question, QuestionStatusDismissed)
+}
 
-	if !isReserved[meetingId] {
-		isReserved[meetingId] = true
-		fmt.Printf("Log: 開始通知を予約しました: %s in sendStartMeetingMessage\n", startTime.In(location))
-		time.Sleep(time.Until(startTime.In(location)))
-		message := ModeratorMsg{
-			MessageType:      ModeratorMsgType,
-			MeetingId:        meetingId,
-			ModeratorMsgBody: meetingStart(meetingId),
-			IsStartPresen:    true,
-			QuestionId:       -1,
-			QuestionUserId:   "",
-			PresentOrder:     0,
+// closePendingQuestion は承認待ちの質問をstatusにする．
+// 公開されていない質問のため，主催者，共同司会者と質問者本人にのみ通知する
+func (c *Client) closePendingQuestion(question Question, status string) (interface{}, *ProtocolError) {
+	if !closePendingQuestion(db, question.QuestionId, status) {
+		return nil, newProtocolError(ErrorCodeFailed, "質問の取り下げに失敗しました")
+	}
+	question.Status = status
+	return RestrictedMessage{
+		UserIds: append(getModeratorUserIds(db, c.meetingId), question.UserId),
+		Message: newQuestionStatusResult(c.meetingId, question),
+	}, nil
+}
+
+func (c *Client) handleQuestionVote(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionVoteMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !c.isOwnIdentity("question_vote", c.userId, getQuestionMeetingId(db, request.QuestionId)) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の質問には投票できません")
+	}
+
+	meetingId, questionId, voteNum := voteQuestion(db, c.userId, request.QuestionId, *request.IsVote)
+	if meetingId == -1 {
+		return nil, newProtocolError(ErrorCodeFailed, "投票に失敗しました")
+	}
+
+	return QuestionVoteResult{
+		MessageType: "question_vote",
+		MeetingId:   meetingId,
+		QuestionId:  questionId,
+		VoteNum:     voteNum,
+	}, nil
+}
+
+func (c *Client) handleQuestionEdit(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionEditMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if !c.isOwnIdentity("question_edit", question.UserId, getDocumentMeetingId(db, question.DocumentId)) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の参加者の質問は編集できません")
+	}
+	status := questionStatus(question)
+	if status != QuestionStatusOpen && status != QuestionStatusPending {
+		return nil, newProtocolError(ErrorCodeInvalidState, "回答済みや取り下げられた質問は編集できません")
+	}
+
+	// 承認制の場合は，承認済みの質問も編集後の本文が承認されるまで承認待ちに戻す
+	setting := getMeetingSetting(db, c.meetingId)
+	if setting.QuestionApprovalRequired || status == QuestionStatusPending {
+		if !resubmitQuestion(db, request.QuestionId, request.QuestionBody) {
+			return nil, newProtocolError(ErrorCodeFailed, "質問の編集に失敗しました")
+		}
+		if status == QuestionStatusOpen {
+			// 公開中の質問は全員の一覧から隠す．編集後の本文は承認されるまで送らない
+			hidden := question
+			hidden.Status = QuestionStatusPending
+			c.hub.broadcastToRoom(c.meetingId, newQuestionStatusResult(c.meetingId, hidden))
 		}
-		messagejson, _ := json.Marshal(message)
-		hub.broadcast <- messagejson
-		fmt.Printf("Log: 開始通知を送信しました: %s in sendStartMeetingMessage\n", time.Now().In(location))
-		setMeetingDone(db, meetingId)
+		question.QuestionBody = request.QuestionBody
+		question.Status = QuestionStatusPending
+		question.QuestionOk = true
+		return newPendingQuestionMessage(c.meetingId, question, setting), nil
+	}
+
+	if !editQuestion(db, request.QuestionId, request.QuestionBody) {
+		return nil, newProtocolError(ErrorCodeFailed, "質問の編集に失敗しました")
+	}
+	question.QuestionBody = request.QuestionBody
+	return newQuestionStatusResult(c.meetingId, question), nil
+}
+
+func (c *Client) handleQuestionWithdraw(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionCloseMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if !c.isOwnIdentity("question_withdraw", question.UserId, getDocumentMeetingId(db, question.DocumentId)) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の参加者の質問は取り下げられません")
+	}
+	// 承認待ちの質問も承認される前に取り下げられる
+	if questionStatus(question) == QuestionStatusPending {
+		return c.closePendingQuestion(question, QuestionStatusWithdrawn)
+	}
+	return c.closeOpenQuestion(question, QuestionStatusWithdrawn)
+}
+
+func (c *Client) handleQuestionDismiss(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionCloseMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if getDocumentMeetingId(db, question.DocumentId) != c.meetingId || !canModerateQuestion(db, c.meetingId, c.userId, question) {
+		return nil, newProtocolError(ErrorCodeForbidden, "この質問は取り下げられません")
+	}
+	return c.closeOpenQuestion(question, QuestionStatusDismissed)
+}
+
+func (c *Client) handleQuestionAnswered(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionCloseMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if getDocumentMeetingId(db, question.DocumentId) != c.meetingId || !canModerateQuestion(db, c.meetingId, c.userId, question) {
+		return nil, newProtocolError(ErrorCodeForbidden, "この質問は回答済みにできません")
+	}
+	return c.closeOpenQuestion(question, QuestionStatusAnswered)
+}
+
+// closeOpenQuestion は未回答の質問をstatusにし，変更後の質問の状態を返す
+func (c *Client) closeOpenQuestion(question Question, status string) (interface{}, *ProtocolError) {
+	if questionStatus(question) != QuestionStatusOpen {
+		return nil, newProtocolError(ErrorCodeInvalidState, "未回答の質問ではありません: %d", question.QuestionId)
+	}
+	if !closeQuestion(db, question.QuestionId, status) {
+		return nil, newProtocolError(ErrorCodeFailed, "質問の状態の更新に失敗しました")
+	}
+	question.Status = status
+	question.QuestionOk = true
+	return newQuestionStatusResult(c.meetingId, question), nil
+}
+
+func (c *Client) handleQuestionMerge(data []byte) (interface{}, *ProtocolError) {
+	request := new(QuestionMergeMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	ok, question := getQuestion(db, request.QuestionId)
+	if !ok || question.IsVoice {
+		return nil, newProtocolError(ErrorCodeInvalidField, "質問が存在しません: %d", request.QuestionId)
+	}
+	if getDocumentMeetingId(db, question.DocumentId) != c.meetingId || !canModerateQuestion(db, c.meetingId, c.userId, question) {
+		return nil, newProtocolError(ErrorCodeForbidden, "この質問は統合できません")
+	}
+	ok, target := getQuestion(db, request.TargetQuestionId)
+	if !ok || target.IsVoice || target.DocumentId != question.DocumentId {
+		return nil, newProtocolError(ErrorCodeInvalidField, "統合先は同じ資料への質問にしてください: %d", request.TargetQuestionId)
+	}
+	if questionStatus(question) != QuestionStatusOpen || questionStatus(target) != QuestionStatusOpen {
+		return nil, newProtocolError(ErrorCodeInvalidState, "未回答の質問同士のみ統合できます")
+	}
+
+	ok, voteNum := mergeQuestion(db, request.QuestionId, request.TargetQuestionId)
+	if !ok {
+		return nil, newProtocolError(ErrorCodeFailed, "質問の統合に失敗しました")
+	}
+	// 統合先の投票数は個別に通知し，統合元の状態を送信者の結果とする
+	c.hub.broadcastToRoom(c.meetingId, QuestionVoteResult{
+		MessageType: "question_vote",
+		MeetingId:   c.meetingId,
+		QuestionId:  request.TargetQuestionId,
+		VoteNum:     voteNum,
+	})
+	question.Status = QuestionStatusMerged
+	question.QuestionOk = true
+	question.MergedInto = request.TargetQuestionId
+	question.VoteNum = 0
+	return newQuestionStatusResult(c.meetingId, question), nil
+}
+
+func (c *Client) handleHandsUp(data []byte) (interface{}, *ProtocolError) {
+	request := new(HandsUpMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !c.isOwnIdentity("handsup", request.UserId, getDocumentMeetingId(db, request.DocumentId)) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の参加者や会議の挙手はできません")
+	}
+
+	var meetingId int
+	if *request.IsUp {
+		meetingId = handsUp(db, request.UserId, request.DocumentId, request.DocumentPage)
 	} else {
-		fmt.Printf("Log: 開始通知は既に予約済です: %s in sendStartMeetingMessage\n", startTime.In(location))
+		meetingId = handsDown(db, request.UserId, request.DocumentId, request.DocumentPage)
+	}
+	if meetingId == -1 {
+		return nil, newProtocolError(ErrorCodeFailed, "挙手の更新に失敗しました")
+	}
+
+	queueUserIds := getHandQueueUserIds(db, request.DocumentId)
+	return HandsUpResult{
+		MessageType:  "handsup",
+		MeetingId:    meetingId,
+		UserId:       request.UserId,
+		DocumentId:   request.DocumentId,
+		Position:     getHandPosition(queueUserIds, request.UserId),
+		QueueUserIds: queueUserIds,
+	}, nil
+}
+
+func (c *Client) handleHandsReorder(data []byte) (interface{}, *ProtocolError) {
+	request := new(HandsReorderMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if getDocumentMeetingId(db, request.DocumentId) != c.meetingId {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の挙手は並べ替えられません")
+	}
+	if !reorderHands(db, request.DocumentId, request.UserIds) {
+		return nil, newProtocolError(ErrorCodeFailed, "挙手の並べ替えに失敗しました")
+	}
+	return newHandQueueResult(db, c.meetingId, request.DocumentId), nil
+}
+
+func (c *Client) handleHandsClear(data []byte) (interface{}, *ProtocolError) {
+	request := new(HandsClearMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if getDocumentMeetingId(db, request.DocumentId) != c.meetingId {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の挙手は取り消せません")
+	}
+	if !clearHands(db, request.DocumentId) {
+		return nil, newProtocolError(ErrorCodeFailed, "挙手の取り消しに失敗しました")
+	}
+	return newHandQueueResult(db, c.meetingId, request.DocumentId), nil
+}
+
+func (c *Client) handleReaction(data []byte) (interface{}, *ProtocolError) {
+	request := new(ReactionMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !c.isOwnIdentity("reaction", c.userId, getDocumentMeetingId(db, request.DocumentId)) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の資料にはリアクションできません")
+	}
+
+	meetingId, reactionNum := voteReaction(db, c.userId, request.DocumentId, request.DocumentPage, *request.IsReaction)
+	if meetingId == -1 {
+		return nil, newProtocolError(ErrorCodeFailed, "リアクションに失敗しました")
+	}
+
+	return ReactionResult{
+		MessageType:  "reaction",
+		MeetingId:    meetingId,
+		DocumentId:   request.DocumentId,
+		DocumentPage: request.DocumentPage,
+		ReactionNum:  reactionNum,
+	}, nil
+}
+
+func (c *Client) handleAgendaReorder(data []byte) (interface{}, *ProtocolError) {
+	request := new(AgendaReorderMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
 	}
+	if !reorderPresenters(db, c.meetingId, request.PresenterIds) {
+		return nil, newProtocolError(ErrorCodeFailed, "発表順の並べ替えに失敗しました")
+	}
+	return newAgendaResult(db, c.meetingId), nil
+}
+
+func (c *Client) handleAgendaInsert(data []byte) (interface{}, *ProtocolError) {
+	request := new(AgendaInsertMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !insertPresenter(db, c.meetingId, request.PresenterId, request.Position) {
+		return nil, newProtocolError(ErrorCodeFailed, "発表者の追加に失敗しました")
+	}
+	return newAgendaResult(db, c.meetingId), nil
+}
+
+func (c *Client) handleAgendaPostpone(data []byte) (interface{}, *ProtocolError) {
+	request := new(AgendaPostponeMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !postponePresenter(db, c.meetingId, request.PresenterId) {
+		return nil, newProtocolError(ErrorCodeFailed, "発表の後回しに失敗しました")
+	}
+	return newAgendaResult(db, c.meetingId), nil
+}
+
+func (c *Client) handleFinishWord(data []byte) (interface{}, *ProtocolError) {
+	request := new(FinishWordMessage)
+	if perr := decodeMessage(data, request); perr != nil {
+		return nil, perr
+	}
+	if !c.isOwnIdentity("finishword", c.userId, request.MeetingId) {
+		return nil, newProtocolError(ErrorCodeForbidden, "他の会議の発表は終了できません")
+	}
+	// 発表の終了は発表者本人，主催者，共同司会者のみ可能
+	if !canFinishPresen(db, request.MeetingId, c.userId, request.PresenterId) {
+		fmt.Printf("Error: 発表を終了する権限がありません: %d, %s, %s in handleFinishWord\n", request.MeetingId, c.userId, request.PresenterId)
+		return nil, newProtocolError(ErrorCodeForbidden, "この発表を終了する権限がありません")
+	}
+
+	ok, message := c.hub.progress.finish(request.MeetingId, request.PresenterId, request.FinishType)
+	if !ok {
+		return nil, newProtocolError(ErrorCodeInvalidState, "会議の進行状態と一致しません")
+	}
+	return message, nil
+}
+
+// isOwnIdentity はメッセージ内のユーザーIDと会議IDが，接続時に認証したものと一致するか確認する
+func (c *Client) isOwnIdentity(messageType string, userId string, meetingId int) bool {
+	if userId != c.userId || meetingId != c.meetingId {
+		fmt.Printf("Error: 認証情報と一致しないメッセージを破棄しました: %s, %s, %d (認証: %s, %d) in isOwnIdentity\n", messageType, userId, meetingId, c.userId, c.meetingId)
+		return false
+	}
+	return true
+}
+
+// sendStartMeetingMessage は会議の開始を通知する．Schedulerから開始時刻に呼び出される．
+func (hub *Hub) sendStartMeetingMessage(meetingId int) {
+	location, _ := time.LoadLocation("Asia/Tokyo")
+
+	// 開始済みにできた場合のみ通知する(二重の通知を防ぐ)
+	ok, state := transitMeetingState(db, meetingId, MeetingState{State: MeetingStateStarted, PresentOrder: -1})
+	if !ok {
+		fmt.Printf("Log: 開始通知は既に送信済です: %d in sendStartMeetingMessage\n", meetingId)
+		return
+	}
+	hub.sendMeetingState(state)
+	// 最初の発表者も在席を確かめてから決める
+	if ok, message := hub.progress.start(meetingId); ok {
+		hub.broadcastToRoom(meetingId, message)
+	}
+	fmt.Printf("Log: 開始通知を送信しました: %s in sendStartMeetingMessage\n", time.Now().In(location))
 }
 
 func (hub *Hub) sendDocumentUpdate(meetingId int, documentId int) {
@@ -362,8 +752,7 @@ func (hub *Hub) sendDocumentUpdate(meetingId int, documentId int) {
 		MeetingId:   meetingId,
 		DocumentId:  documentId,
 	}
-	messagejson, _ := json.Marshal(messagestruct)
-	hub.broadcast <- messagejson
+	hub.broadcastToRoom(meetingId, messagestruct)
 	fmt.Printf("Log: 資料更新通知を送信しました:%d, %d in sendDocumentUpdate\n", meetingId, documentId)
 }
 
@@ -417,7 +806,35 @@ func (c *Client) writePump() {
 }
 
 // serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+//
+// userIdはrequireAuthで認証済みのユーザーで，会議IDはクエリパラメータで指定する
+// (例: /ws?meetingId=12&token=xxxx)．
+// ユーザーがその会議の参加者でない場合はUpgradeしない．
+func serveWs(hub *Hub, userId string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	meetingId, err := strconv.Atoi(query.Get("meetingId"))
+	if err != nil {
+		fmt.Printf("Error: 会議IDが不正です: %s in serveWs\n", query.Get("meetingId"))
+		http.Error(w, "meetingId is required", http.StatusBadRequest)
+		return
+	}
+	if !isParticipant(db, meetingId, userId) {
+		fmt.Printf("Error: 会議の参加者ではありません: %d, %s in serveWs\n", meetingId, userId)
+		http.Error(w, "not a participant of the meeting", http.StatusForbidden)
+		return
+	}
+
+	// 再接続の場合は最後に受け取ったメッセージの通し番号が指定される
+	lastSeq := int64(-1)
+	if query.Get("lastSeq") != "" {
+		lastSeq, err = strconv.ParseInt(query.Get("lastSeq"), 10, 64)
+		if err != nil || lastSeq < 0 {
+			fmt.Printf("Error: 通し番号が不正です: %s in serveWs\n", query.Get("lastSeq"))
+			http.Error(w, "invalid lastSeq", http.StatusBadRequest)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		fmt.Printf("Error: Web SocketへのUpgradeに失敗しました in serveWs\n")
@@ -427,8 +844,8 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("Log: Web SocketへのUpgradeに成功しました in serveWs\n")
 	}
 	// sendは他の人からのメッセージが投入される
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client // hubのregisterチャネルに自分のClientを登録
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), meetingId: meetingId, userId: userId, lastSeq: lastSeq}
+	client.hub.register <- client // hubのregisterチャネルに自分のClientを登録(取りこぼしたメッセージか最新の状態が送られる)
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -20,7 +20,8 @@ type Meeting struct {
 	MeetingId        int       `gorm:"AUTO_INCREMENT"`
 	MeetingName      string    //`json:"meeting_name`
 	MeetingStartTime time.Time //`json:meeting_start_time`
-	MeetingDone      bool      //`json:meeting_done`
+	MeetingDone      bool      //`json:meeting_done` 終了済みか(進行状態はMeetingStateを参照)
+	MeetingCanceled  bool      `gorm:"not null;default:false"`
 }
 
 type Participant struct {
@@ -29,18 +30,25 @@ type Participant struct {
 	SpeakNum         int    //`json:"speaknum"`
 	ParticipantOrder int    //`json:"participantorder"`
 	IsJoining        bool
+	Role             string     `gorm:"default:'audience'"` // organizer, presenter, audience, moderator
+	ExitTime         *time.Time // 最後に退出した時刻
+	IsDeferred       bool       `gorm:"not null;default:false"` // 不在のため発表を最後に回されたか
 }
 
 type Question struct {
-	QuestionId   int `gorm:"AUTO_INCREMENT"`
-	UserId       string
-	QuestionBody string
-	DocumentId   int
-	DocumentPage int
-	VoteNum      int
-	QuestionTime time.Time
-	QuestionOk   bool
-	IsVoice      bool
+	QuestionId    int `gorm:"AUTO_INCREMENT"`
+	UserId        string
+	QuestionBody  string
+	DocumentId    int
+	DocumentPage  int
+	VoteNum       int
+	QuestionTime  time.Time
+	QuestionOk    bool
+	IsVoice       bool
+	QueuePosition int    `gorm:"not null;default:0"`       // 挙手の待ち行列での並び順(小さいほど先に当てる)
+	Status        string `gorm:"not null;default:''"`      // 投稿された質問の状態(question.goのQuestionStatus*)．既存の質問は空
+	MergedInto    int    `gorm:"not null;default:0"`       // 統合先の質問ID
+	ClusterId     int    `gorm:"not null;default:0;index"` // 似た質問のまとまりのID(まとまりの最初の質問ID)．まとまりに属さない場合は0
 }
 
 type QuestionAndPresenterId struct {
@@ -51,6 +59,8 @@ type QuestionAndPresenterId struct {
 	QuestionTime time.Time
 	UserId       string
 	VoteNum      int
+	Status       string
+	QuestionOk   bool
 }
 
 type Document struct {
@@ -122,31 +132,59 @@ func connectDB() *gorm.DB {
 	return db
 }
 
+// migrateDB は不足しているテーブルとカラムを作成する
+func migrateDB(db *gorm.DB) {
+	if err := db.AutoMigrate(&Session{}, &Meeting{}, &Participant{}, &Question{}, &MeetingSetting{}, &MeetingState{}, &QuestionVote{}, &ReactionVote{}).Error; err != nil {
+		panic(err.Error())
+	}
+	backfillParticipantRoles(db)
+	fmt.Printf("Log: DBのマイグレーションに成功しました in migrateDB\n")
+}
+
 func signupUser(db *gorm.DB, userId string, userName string, userPassword string) bool {
-	user := User{UserId: userId, UserName: userName, UserPassword: userPassword}
+	passwordHash, hash_err := hashPassword(userPassword)
+	if hash_err != nil {
+		fmt.Printf("Error: signup失敗(パスワードのハッシュ化に失敗しました): %s, %s in signupUser\n", userId, userName)
+		return false
+	}
+	user := User{UserId: userId, UserName: userName, UserPassword: passwordHash}
 	if err := db.Create(&user).Error; err == nil {
-		fmt.Printf("Log: signup成功: %s, %s, %s in signupUser\n", userId, userName, userPassword)
+		fmt.Printf("Log: signup成功: %s, %s in signupUser\n", userId, userName)
 		return true
 	} else {
-		fmt.Printf("Error: signup失敗: %s, %s, %s in signupUser\n", userId, userName, userPassword)
+		fmt.Printf("Error: signup失敗: %s, %s in signupUser\n", userId, userName)
 		return false
 	}
 }
 
 func loginUser(db *gorm.DB, userId string, userPassword string) (bool, string) {
 	var user User
-	// err := db.Find(&user).Error
-	err := db.First(&user, "user_id = ? AND user_password = ?", userId, userPassword).Error
-	if err == nil {
-		fmt.Printf("Log: login成功: %s, %s in loginUser\n", userId, userPassword)
-		return true, user.UserName
-	} else {
-		fmt.Printf("Error: login失敗: %s, %s in loginUser\n", userId, userPassword)
+	if err := db.First(&user, "user_id = ?", userId).Error; err != nil {
+		// ユーザーの存在有無で応答時間が変わらないように照合だけは行う
+		verifyPassword(string(dummyPasswordHash), userPassword)
+		fmt.Printf("Error: login失敗: %s in loginUser\n", userId)
+		return false, ""
+	}
+	isValid, needsRehash := verifyPassword(user.UserPassword, userPassword)
+	if !isValid {
+		fmt.Printf("Error: login失敗: %s in loginUser\n", userId)
 		return false, ""
 	}
+	if needsRehash {
+		// 平文で保存されていたパスワードをハッシュ化して保存し直す
+		if passwordHash, hash_err := hashPassword(userPassword); hash_err != nil {
+			fmt.Printf("Error: パスワードのハッシュ化に失敗しました: %s in loginUser\n", userId)
+		} else if update_err := db.Model(&user).Where("user_id = ?", userId).Update("user_password", passwordHash).Error; update_err != nil {
+			fmt.Printf("Error: update失敗(パスワードの再ハッシュ化に失敗しました): %s in loginUser\n", userId)
+		} else {
+			fmt.Printf("Log: update成功(パスワードを再ハッシュ化しました): %s in loginUser\n", userId)
+		}
+	}
+	fmt.Printf("Log: login成功: %s in loginUser\n", userId)
+	return true, user.UserName
 }
 
-func createMeeting(db *gorm.DB, meetingName string, startTimeStr string, presenterIds []string) (bool, int, string) {
+func createMeeting(db *gorm.DB, organizerId string, meetingName string, startTimeStr string, presenterIds []string) (bool, int, string) {
 	var (
 		user         User
 		layout       = "2006/01/02 15:04:05"
@@ -156,9 +194,16 @@ func createMeeting(db *gorm.DB, meetingName string, startTimeStr string, present
 	)
 
 	if err := db.Create(&meeting).Error; err == nil {
+		isOrganizerPresenter := false
 		for i, presenter := range presenterIds {
 			if err := db.First(&user, "user_id = ?", presenter).Error; err == nil {
-				participant := Participant{MeetingId: meeting.MeetingId, UserId: user.UserId, SpeakNum: 0, ParticipantOrder: i, IsJoining: false}
+				role := RolePresenter
+				if user.UserId == organizerId {
+					// 主催者が発表もする場合は主催者の役割を優先する
+					role = RoleOrganizer
+					isOrganizerPresenter = true
+				}
+				participant := Participant{MeetingId: meeting.MeetingId, UserId: user.UserId, SpeakNum: 0, ParticipantOrder: i, IsJoining: false, Role: role}
 				if err := db.Create(&participant).Error; err == nil {
 					document := Document{UserId: user.UserId, MeetingId: meeting.MeetingId}
 					if err := db.Create(&document).Error; err != nil {
@@ -174,6 +219,13 @@ func createMeeting(db *gorm.DB, meetingName string, startTimeStr string, present
 				return false, -1, ""
 			}
 		}
+		if !isOrganizerPresenter {
+			organizer := Participant{MeetingId: meeting.MeetingId, UserId: organizerId, SpeakNum: 0, ParticipantOrder: -1, IsJoining: false, Role: RoleOrganizer}
+			if err := db.Create(&organizer).Error; err != nil {
+				fmt.Printf("Error: create失敗(主催者%sの登録に失敗しました): %s, %s, %s in createMeeting\n", organizerId, meetingName, startTimeStr, presenterIds)
+				return false, -1, ""
+			}
+		}
 		fmt.Printf("Log: create成功: %s, %s, %s in createMeeting\n", meetingName, startTimeStr, presenterIds)
 		return true, meeting.MeetingId, meeting.MeetingName
 	} else {
@@ -186,10 +238,8 @@ func joinMeeting(db *gorm.DB, userId string, meetingId int) (bool, string, time.
 	var user User
 	var meeting Meeting
 	var participant Participant
-	var document Document
-	participants := make([]Participant, 0, 10)
 	user_info := db.First(&user, "user_id = ?", userId)
-	meeting_info := db.First(&meeting, "meeting_id = ?", meetingId)
+	meeting_info := db.First(&meeting, "meeting_id = ? AND meeting_canceled = ?", meetingId, false)
 	if user_info.Error == nil && meeting_info.Error == nil {
 		participant_info := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, userId).Where(&participant, "meeting_id = ? AND user_id = ?", meetingId, userId).Update("is_joining", true)
 		if participant_info.Error != nil {
@@ -198,6 +248,7 @@ func joinMeeting(db *gorm.DB, userId string, meetingId int) (bool, string, time.
 			participant.SpeakNum = 0
 			participant.ParticipantOrder = -1
 			participant.IsJoining = true
+			participant.Role = RoleAudience
 			if err := db.Create(&participant).Error; err == nil {
 				fmt.Printf("Log: 参加者追加成功: %s, %d in joinMeeting\n", userId, meetingId)
 			} else {
@@ -210,32 +261,10 @@ func joinMeeting(db *gorm.DB, userId string, meetingId int) (bool, string, time.
 				return false, "false", time.Now(), []string{}, []string{}, []int{}
 			}
 		}
-		if db.Find(&participants, "meeting_id = ? AND participant_order != ?", meetingId, -1); len(participants) == 0 {
-			fmt.Printf("Error: 発表者非存在: %d in joinMeeting\n", meetingId)
+		isPresenterFound, presenter_names, presenter_ids, document_ids := getPresenters(db, meetingId)
+		if !isPresenterFound {
 			return false, "false", time.Now(), []string{}, []string{}, []int{}
 		}
-		presenter_names := make([]string, 0, 10)
-		presenter_ids := make([]string, 0, 10)
-		document_ids := make([]int, 0, 10)
-
-		sort.Sort(ByParticipantOrder(participants))
-
-		for _, p := range participants {
-			presenter_id := p.UserId
-			user_err := db.First(&user, "user_id = ?", presenter_id).Error
-			if user_err != nil {
-				fmt.Printf("Error: ユーザー非存在: %s in joinMeeting\n", presenter_id)
-				return false, "false", time.Now(), []string{}, []string{}, []int{}
-			}
-			document_err := db.First(&document, "user_id = ? AND meeting_id = ?", p.UserId, p.MeetingId).Error
-			if document_err != nil {
-				fmt.Printf("Error: 資料非存在: %s, %d in joinMeeting\n", p.UserId, p.MeetingId)
-				return false, "false", time.Now(), []string{}, []string{}, []int{}
-			}
-			presenter_names = append(presenter_names, user.UserName)
-			presenter_ids = append(presenter_ids, user.UserId)
-			document_ids = append(document_ids, document.DocumentId)
-		}
 
 		fmt.Printf("Log: join成功: %s, %d in joinMeeting\n", userId, meetingId)
 		return true, meeting.MeetingName, meeting.MeetingStartTime, presenter_names, presenter_ids, document_ids
@@ -246,10 +275,46 @@ func joinMeeting(db *gorm.DB, userId string, meetingId int) (bool, string, time.
 	}
 }
 
+// getPresenters は発表順に並べた発表者の名前，ID，資料IDを返す
+func getPresenters(db *gorm.DB, meetingId int) (bool, []string, []string, []int) {
+	var (
+		user         User
+		document     Document
+		participants = make([]Participant, 0, 10)
+	)
+	if db.Find(&participants, "meeting_id = ? AND participant_order != ?", meetingId, -1); len(participants) == 0 {
+		fmt.Printf("Error: 発表者非存在: %d in getPresenters\n", meetingId)
+		return false, []string{}, []string{}, []int{}
+	}
+	presenter_names := make([]string, 0, 10)
+	presenter_ids := make([]string, 0, 10)
+	document_ids := make([]int, 0, 10)
+
+	sort.Sort(ByParticipantOrder(participants))
+
+	for _, p := range participants {
+		presenter_id := p.UserId
+		user_err := db.First(&user, "user_id = ?", presenter_id).Error
+		if user_err != nil {
+			fmt.Printf("Error: ユーザー非存在: %s in getPresenters\n", presenter_id)
+			return false, []string{}, []string{}, []int{}
+		}
+		document_err := db.First(&document, "user_id = ? AND meeting_id = ?", p.UserId, p.MeetingId).Error
+		if document_err != nil {
+			fmt.Printf("Error: 資料非存在: %s, %d in getPresenters\n", p.UserId, p.MeetingId)
+			return false, []string{}, []string{}, []int{}
+		}
+		presenter_names = append(presenter_names, user.UserName)
+		presenter_ids = append(presenter_ids, user.UserId)
+		document_ids = append(document_ids, document.DocumentId)
+	}
+	return true, presenter_names, presenter_ids, document_ids
+}
+
 func exitMeeting(db *gorm.DB, userId string, meetingId int, documentId int) bool {
 	var participant Participant
 	var question Question
-	if participant_err := db.Model(&participant).Where("meeting_id = ? AND user_id = ?", meetingId, userId).Update("is_joining", false).Error; participant_err != nil {
+	if participant_err := db.Model(&participant).Where("meeting_id = ? AND user_id = ?", meetingId, userId).Updates(map[string]interface{}{"is_joining": false, "exit_time": time.Now()}).Error; participant_err != nil {
 		fmt.Printf("Error: update失敗(参加者の参加状態の更新に失敗しました): %d, %s in exitMeeting\n", meetingId, userId)
 		return false
 	}
@@ -299,125 +364,34 @@ func createQuestion(db *gorm.DB, question Question) (bool, int) {
 	return true, question.QuestionId
 }
 
-func selectQuestion(db *gorm.DB, meetingId, documentId int, presenterId string, questionUserId string) (bool, bool, string, int) {
-	pickQuestioner := true
-	suggestQuestion := false
-	var question Question
-	var participant Participant
-	nextQuestionUserId := ""
-	location, _ := time.LoadLocation("Asia/Tokyo")
-
-	if voice_question_err := db.First(&question, "document_id = ? AND question_ok = ? AND is_voice = ?", documentId, false, true).Error; voice_question_err == nil {
-		if question_err := db.Model(&question).Where("question_id = ?", question.QuestionId).Update("question_ok", true).Error; question_err != nil {
-			fmt.Printf("Error: update失敗(質問の回答状況の更新に失敗しました): %d in selectQuestion\n", question.QuestionId)
-			return false, false, "", -1
-		}
-		if incSpeakNum_err := db.Model(&participant).Where("meeting_id = ? AND user_id = ?", meetingId, question.UserId).Update("speak_num", participant.SpeakNum+1).Error; incSpeakNum_err != nil {
-			fmt.Printf("Error: update失敗(参加者の話数の更新に失敗しました): %s, %d, %d in selectQuestion\n", participant.UserId, participant.MeetingId, participant.SpeakNum)
-			return false, false, "", -1
-		}
-		nextQuestionUserId = question.UserId
-		return pickQuestioner, suggestQuestion, nextQuestionUserId, question.QuestionId
-	} else {
-		questions := make([]Question, 0, 10)
-		if db.Find(&questions, "document_id = ? AND question_ok = ? AND is_voice = ?", documentId, false, false); len(questions) != 0 {
-			sort.Sort(ReverseByVoteNum(questions))
-			question = questions[0]
-			if question_err := db.Model(&question).Where("question_id = ?", question.QuestionId).Update("question_ok", true).Error; question_err != nil {
-				fmt.Printf("Error: update失敗(質問の回答状況の更新に失敗しました): %d in selectQuestion\n", question.QuestionId)
-				return false, false, "", -1
-			}
-			pickQuestioner = false
-			if incSpeakNum_err := db.Model(&participant).Where("meeting_id = ? AND user_id = ?", meetingId, question.UserId).Update("speak_num", participant.SpeakNum+1).Error; incSpeakNum_err != nil {
-				fmt.Printf("Error: update失敗(参加者の話数の更新に失敗しました): %s, %d, %d in selectQuestion\n", participant.UserId, participant.MeetingId, participant.SpeakNum)
-				return false, false, "", -1
-			}
-		}
-	}
-	if pickQuestioner {
-		participants := make([]Participant, 0, 10)
-		if db.Find(&participants, "meeting_id = ? AND user_id != ? AND user_id != ? AND is_joining = ?", meetingId, presenterId, questionUserId, true); len(participants) != 0 {
-			reactions := make([]Reaction, 0, 10)
-			if db.Find(&reactions, "document_id = ? AND suggestion_ok = ?", documentId, false); len(reactions) != 0 {
-				sort.Sort(ReverseByReactionNum(reactions))
-				if reactions[0].ReactionNum >= len(participants)/2 {
-					if reaction_err := db.Model(&reactions[0]).Where("document_id = ? AND document_page = ?", reactions[0].DocumentId, reactions[0].DocumentPage).Update("suggestion_ok", true).Error; reaction_err != nil {
-						fmt.Printf("Error: update失敗(資料リアクションの提案状況の更新に失敗しました): %d, %d in selectQuestion\n", reactions[0].DocumentId, reactions[0].DocumentPage)
-						return false, false, "", -1
-					}
-					question = Question{
-						UserId:       "Moderator",
-						QuestionBody: fmt.Sprintf("%dページについての詳しい説明を要求．", reactions[0].DocumentPage),
-						DocumentId:   reactions[0].DocumentId,
-						DocumentPage: reactions[0].DocumentPage,
-						VoteNum:      reactions[0].ReactionNum,
-						QuestionTime: time.Now().In(location),
-						QuestionOk:   true,
-						IsVoice:      false,
-					}
-					if err := db.Create(&question).Error; err != nil {
-						fmt.Printf("Error: create失敗(質問の登録に失敗しました): %s, %d, %s in selectQuestion\n", question.UserId, question.DocumentId, question.QuestionTime)
-						return false, false, "", -1
-					}
-					fmt.Printf("Log: create成功(質問の登録に成功しました): %s, %d, %s in selectQuestion\n", question.UserId, question.DocumentId, question.QuestionTime)
-					pickQuestioner = false
-					suggestQuestion = true
-					return pickQuestioner, suggestQuestion, nextQuestionUserId, question.QuestionId
-				}
-			}
-			sort.Sort(BySpeakNum(participants))
-			// rand_max := 3
-			// if len(participants) < 3 {
-			//	rand_max = len(participants)
-			// }
-			// participant = participants[rand.Intn(rand_max)]
-			participant = participants[0]
-			nextQuestionUserId = participant.UserId
-			question = Question{
-				UserId:       nextQuestionUserId,
-				QuestionBody: "",
-				DocumentId:   documentId,
-				DocumentPage: 1,
-				VoteNum:      0,
-				QuestionTime: time.Now().In(location),
-				QuestionOk:   true,
-				IsVoice:      true,
-			}
-			if err := db.Create(&question).Error; err != nil {
-				fmt.Printf("Error: create失敗(質問の登録に失敗しました): %s, %d, %s in selectQuestion\n", question.UserId, question.DocumentId, question.QuestionTime)
-				return false, false, "", -1
-			}
-			if err := db.Model(&participant).Where("user_id = ? AND meeting_id = ?", participant.UserId, participant.MeetingId).Update("speak_num", participant.SpeakNum+1).Error; err != nil {
-				fmt.Printf("Error: update失敗(参加者の話数の更新に失敗しました): %s, %d, %d in selectQuestion\n", participant.UserId, participant.MeetingId, participant.SpeakNum)
-				return false, false, "", -1
-			}
-			fmt.Printf("Log: create成功(質問の登録に成功しました): %s, %d, %s in selectQuestion\n", question.UserId, question.DocumentId, question.QuestionTime)
-
-		} else {
-			fmt.Printf("Error: 参加者が非存在: %d in selectQuestion\n", meetingId)
-			return false, false, "", -1
-		}
-	}
-	return pickQuestioner, suggestQuestion, nextQuestionUserId, question.QuestionId
-}
-
-func voteQuestion(db *gorm.DB, questionId int, isVote bool) (int, int, int) {
+// voteQuestion はユーザーの質問への投票をisVoteの状態にし，投票の件数を投票数とする
+func voteQuestion(db *gorm.DB, userId string, questionId int, isVote bool) (int, int, int) {
 	var question Question
 	var document Document
 	if err := db.First(&question, "question_id = ?", questionId).Error; err != nil {
 		fmt.Printf("Error: 質問が非存在: %d in voteQuestion\n", questionId)
 		return -1, -1, -1
 	}
-	voteNum := question.VoteNum
-	if isVote {
-		voteNum += 1
-	} else {
-		voteNum -= 1
+	// 統合や取り下げで閉じた質問には投票できない
+	if status := questionStatus(question); status != QuestionStatusOpen && status != QuestionStatusAnswered {
+		fmt.Printf("Error: 投票できない質問です: %d, %s in voteQuestion\n", questionId, status)
+		return -1, -1, -1
 	}
-	if err := db.Model(&question).Where("question_id = ?", questionId).Update("vote_num", voteNum).Error; err != nil {
-		fmt.Printf("Error: update失敗(質問の投票数の更新に失敗しました): %d, %d in voteQuestion\n", questionId, voteNum)
+	isVoteOK, delta := setQuestionVote(db, userId, questionId, isVote)
+	if !isVoteOK {
 		return -1, -1, -1
 	}
+	if delta != 0 {
+		if err := db.Model(&Question{}).Where("question_id = ?", questionId).Update("vote_num", gorm.Expr("vote_num + ?", delta)).Error; err != nil {
+			fmt.Printf("Error: update失敗(質問の投票数の更新に失敗しました): %d, %d in voteQuestion\n", questionId, delta)
+			return -1, -1, -1
+		}
+	}
+	if err := db.First(&question, "question_id = ?", questionId).Error; err != nil {
+		fmt.Printf("Error: 質問が非存在: %d in voteQuestion\n", questionId)
+		return -1, -1, -1
+	}
+	voteNum := question.VoteNum
 
 	if err := db.First(&document, "document_id = ?", question.DocumentId).Error; err != nil {
 		fmt.Printf("Error: 資料が非存在: %d in voteQuestion\n", question.DocumentId)
@@ -441,6 +415,12 @@ func handsUp(db *gorm.DB, userId string, documentId int, documentPage int) int {
 		return -1
 	}
 
+	// 既に挙手している場合は順番を変えない
+	if err := db.First(&Question{}, "user_id = ? AND document_id = ? AND question_ok = ? AND is_voice = ?", userId, document.DocumentId, false, true).Error; err == nil {
+		fmt.Printf("Log: 既に挙手しています: %s, %d in handsUp\n", userId, document.DocumentId)
+		return document.MeetingId
+	}
+
 	question := Question{
 		UserId:       userId,
 		QuestionBody: "",
@@ -450,6 +430,9 @@ func handsUp(db *gorm.DB, userId string, documentId int, documentPage int) int {
 		QuestionTime: time.Now().In(location),
 		QuestionOk:   false,
 		IsVoice:      true,
+		Status:       QuestionStatusOpen,
+		// 待ち行列の最後尾に並ぶ
+		QueuePosition: nextHandPosition(db, document.DocumentId),
 	}
 	if question_err := db.Create(&question).Error; question_err != nil {
 		fmt.Printf("Error: create失敗(質問の登録に失敗しました): %s, %d, %d, %s in handsUp\n", question.UserId, question.DocumentId, question.DocumentPage, question.QuestionTime)
@@ -473,7 +456,8 @@ func handsDown(db *gorm.DB, userId string, documentId int, documentPage int) int
 		fmt.Printf("Error: ユーザーが非存在: %s in handsDown\n", userId)
 		return -1
 	}
-	if question_err := db.First(&question, "user_id = ? AND document_id = ? AND document_page = ? AND question_ok = ? AND is_voice = ?", userId, document.DocumentId, documentPage, false, true).Error; question_err != nil {
+	// 挙手は資料ごとに1つのため，挙手したページに関わらず下ろす
+	if question_err := db.First(&question, "user_id = ? AND document_id = ? AND question_ok = ? AND is_voice = ?", userId, document.DocumentId, false, true).Error; question_err != nil {
 		fmt.Printf("Error: 質問が非存在: %s, %d, %d in handsDown\n", userId, document.DocumentId, documentPage)
 		return -1
 	}
@@ -485,7 +469,8 @@ func handsDown(db *gorm.DB, userId string, documentId int, documentPage int) int
 	return document.MeetingId
 }
 
-func voteReaction(db *gorm.DB, documentId int, documentPage int, isReaction bool) (int, int) {
+// voteReaction はユーザーの資料のページへのリアクションをisReactionの状態にし，リアクションの件数をリアクション数とする
+func voteReaction(db *gorm.DB, userId string, documentId int, documentPage int, isReaction bool) (int, int) {
 	var document Document
 	var reaction Reaction
 
@@ -494,15 +479,20 @@ func voteReaction(db *gorm.DB, documentId int, documentPage int, isReaction bool
 		return -1, -1
 	}
 
+	isReactionOK, delta := setReactionVote(db, userId, documentId, documentPage, isReaction)
+	if !isReactionOK {
+		return -1, -1
+	}
+
 	if reaction_err := db.First(&reaction, "document_id = ? AND document_page = ?", documentId, documentPage).Error; reaction_err != nil {
-		if !isReaction {
-			fmt.Printf("Error: 資料リアクションが非存在: %d, %d in voteReaction\n", documentId, documentPage)
-			return -1, -1
+		reactionNum := 0
+		if delta > 0 {
+			reactionNum = delta
 		}
 		reaction = Reaction{
 			DocumentId:   document.DocumentId,
 			DocumentPage: documentPage,
-			ReactionNum:  1,
+			ReactionNum:  reactionNum,
 			SuggestionOk: false,
 		}
 		if create_reaction_err := db.Create(&reaction).Error; create_reaction_err != nil {
@@ -511,33 +501,102 @@ func voteReaction(db *gorm.DB, documentId int, documentPage int, isReaction bool
 		}
 		fmt.Printf("Log: create成功(資料リアクションの登録に成功しました): %d, %d in voteReaction\n", reaction.DocumentId, reaction.DocumentPage)
 	} else {
-		reactionNum := reaction.ReactionNum
-		if isReaction {
-			reactionNum += 1
-		} else {
-			reactionNum -= 1
+		if delta != 0 {
+			if update_reaction_num_err := db.Model(&Reaction{}).Where("document_id = ? AND document_page = ?", reaction.DocumentId, reaction.DocumentPage).Update("reaction_num", gorm.Expr("reaction_num + ?", delta)).Error; update_reaction_num_err != nil {
+				fmt.Printf("Error: update失敗(資料リアクションのリアクション数の更新に失敗しました): %d, %d in voteReaction\n", reaction.DocumentId, reaction.DocumentPage)
+				return -1, -1
+			}
+			fmt.Printf("Log: update成功(資料リアクションのリアクション数の更新に成功しました): %d, %d in voteReaction\n", reaction.DocumentId, reaction.DocumentPage)
 		}
-		if update_reaction_num_err := db.Model(&reaction).Where("document_id = ? AND document_page = ?", reaction.DocumentId, reaction.DocumentPage).Update("reaction_num", reactionNum).Error; update_reaction_num_err != nil {
-			fmt.Printf("Error: update失敗(資料リアクションのリアクション数の更新に失敗しました): %d, %d in voteReaction\n", reaction.DocumentId, reaction.DocumentPage)
+		if reaction_err := db.First(&reaction, "document_id = ? AND document_page = ?", documentId, documentPage).Error; reaction_err != nil {
+			fmt.Printf("Error: 資料リアクションが非存在: %d, %d in voteReaction\n", documentId, documentPage)
 			return -1, -1
 		}
-		fmt.Printf("Log: update成功(資料リアクションのリアクション数の更新に成功しました): %d, %d in voteReaction\n", reaction.DocumentId, reaction.DocumentPage)
 	}
 	return document.MeetingId, reaction.ReactionNum
 }
 
-func getNextPresenterId(db *gorm.DB, meetingId int, nowPresenterId string) (bool, string, int) {
+// getNextPresenterId は現在の発表者の次に発表する，在席している発表者を返す．
+// 不在の発表者は飛ばすか(skippedIds)，会議の設定の猶予内に退出した発表者は一度だけ最後に回す(deferredIds)．
+// nextOrderは最後に回した後の発表順だが，DBは変更しないため，状態の遷移後にdeferPresentersで反映すること．
+func getNextPresenterId(db *gorm.DB, meetingId int, nowPresenterId string) (endPresen bool, nextUserId string, nextOrder int, skippedIds []string, deferredIds []string) {
 	var participant Participant
 	if participant_err := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, nowPresenterId).Error; participant_err != nil {
 		fmt.Printf("Error: 参加者が非存在: %s in getNextPresenterId\n", nowPresenterId)
-		return false, "", -1
+		return false, "", -1, make([]string, 0, 10), make([]string, 0, 10)
+	}
+	return findPresentPresenter(db, meetingId, participant.ParticipantOrder+1)
+}
+
+// getFirstPresenterId は最初に発表する，在席している発表者を返す．不在の発表者の扱いはgetNextPresenterIdと同じ
+func getFirstPresenterId(db *gorm.DB, meetingId int) (endPresen bool, firstUserId string, firstOrder int, skippedIds []string, deferredIds []string) {
+	return findPresentPresenter(db, meetingId, 0)
+}
+
+// findPresentPresenter は発表順nextOrder以降で最初の，在席している発表者を返す
+func findPresentPresenter(db *gorm.DB, meetingId int, nextOrder int) (endPresen bool, nextUserId string, order int, skippedIds []string, deferredIds []string) {
+	var (
+		presenters = make([]Participant, 0, 10)
+		now        = time.Now()
+		grace      = getAbsentPresenterGrace(getMeetingSetting(db, meetingId))
+	)
+	skippedIds = make([]string, 0, 10)
+	deferredIds = make([]string, 0, 10)
+	db.Find(&presenters, "meeting_id = ? AND participant_order != ?", meetingId, -1)
+	sort.Sort(ByParticipantOrder(presenters))
+
+	for nextOrder < len(presenters) {
+		next := presenters[nextOrder]
+		if next.IsJoining {
+			return false, next.UserId, nextOrder, skippedIds, deferredIds
+		}
+		if shouldDeferPresenter(next, now, grace) {
+			// 最後に回すと後ろの発表者が詰めるため，同じ発表順をもう一度調べる
+			fmt.Printf("Log: 不在の発表者を最後に回します: %d, %s in findPresentPresenter\n", meetingId, next.UserId)
+			deferredIds = append(deferredIds, next.UserId)
+			next.IsDeferred = true
+			rest := append([]Participant{}, presenters[nextOrder+1:]...)
+			presenters = append(append(presenters[:nextOrder], rest...), next)
+			continue
+		}
+		fmt.Printf("Log: 不在の発表者を飛ばしました: %d, %s in findPresentPresenter\n", meetingId, next.UserId)
+		// 最後に回した発表者に一巡して戻った場合は，最後に回したことのみを通知する
+		if !containsUserId(deferredIds, next.UserId) {
+			skippedIds = append(skippedIds, next.UserId)
+		}
+		nextOrder += 1
 	}
-	nextOrder := participant.ParticipantOrder + 1
-	if meeting_end_err := db.First(&participant, "meeting_id = ? AND participant_order = ?", meetingId, nextOrder).Error; meeting_end_err != nil {
-		fmt.Printf("Log: 会議終了につき次の発表者が非存在: %d in getNextPresenterId\n", nextOrder)
-		return true, "", -1
+	fmt.Printf("Log: 会議終了につき次の発表者が非存在: %d in findPresentPresenter\n", nextOrder)
+	return true, "", -1, skippedIds, deferredIds
+}
+
+// shouldDeferPresenter は不在の発表者を飛ばさずに最後に回すかを返す．graceが0の場合は常に飛ばす
+func shouldDeferPresenter(participant Participant, now time.Time, grace time.Duration) bool {
+	if grace <= 0 || participant.IsDeferred || participant.ExitTime == nil {
+		return false
 	}
-	return false, participant.UserId, nextOrder
+	return now.Sub(*participant.ExitTime) < grace
+}
+
+// deferPresenters はgetNextPresenterIdで最後に回すと決めた発表者を順に最後に回す
+func deferPresenters(db *gorm.DB, meetingId int, userIds []string) {
+	for _, userId := range userIds {
+		deferPresenter(db, meetingId, userId)
+	}
+}
+
+// deferPresenter は発表者を発表順の最後に回し，再び回されないように記録する．
+// 発表中の発表者より後ろの発表者のみを渡すため，postponePresenterの確認は経ずに並べ替える．
+func deferPresenter(db *gorm.DB, meetingId int, userId string) bool {
+	_, _, nowPresenterIds, _ := getPresenters(db, meetingId)
+	if !setPresenters(db, meetingId, append(removePresenterId(nowPresenterIds, userId), userId)) {
+		return false
+	}
+	if err := db.Model(&Participant{}).Where("meeting_id = ? AND user_id = ?", meetingId, userId).Update("is_deferred", true).Error; err != nil {
+		fmt.Printf("Error: update失敗(発表者を最後に回した記録に失敗しました): %d, %s in deferPresenter\n", meetingId, userId)
+	}
+	fmt.Printf("Log: 不在の発表者を最後に回しました: %d, %s in deferPresenter\n", meetingId, userId)
+	return true
 }
 
 func getUserName(db *gorm.DB, userId string) string {
@@ -549,18 +608,17 @@ func getUserName(db *gorm.DB, userId string) string {
 	return user.UserName
 }
 
-func getFirstPresenUserName(db *gorm.DB, meetingId int) string {
+// getPresenterIdByOrder は発表順orderの発表者を返す
+func getPresenterIdByOrder(db *gorm.DB, meetingId int, order int) string {
 	participants := make([]Participant, 0, 10)
-	if db.Find(&participants, "meeting_id = ? AND participant_order != -1", meetingId); len(participants) == 0 {
-		fmt.Printf("Error: 会議非存在: %d in getFirstPresenUserName\n", meetingId)
+	if db.Find(&participants, "meeting_id = ? AND participant_order != -1", meetingId); len(participants) <= order {
+		fmt.Printf("Error: 会議非存在: %d in getPresenterIdByOrder\n", meetingId)
 		return ""
 	}
 
 	sort.Sort(ByParticipantOrder(participants))
 
-	userName := getUserName(db, participants[0].UserId)
-
-	return userName
+	return participants[order].UserId
 }
 
 func getQuestionBody(db *gorm.DB, questionId int) (string, int) {
@@ -572,6 +630,15 @@ func getQuestionBody(db *gorm.DB, questionId int) (string, int) {
 	return question.QuestionBody, question.DocumentPage
 }
 
+func getQuestionUserId(db *gorm.DB, questionId int) string {
+	var question Question
+	if err := db.First(&question, "question_id = ?", questionId).Error; err != nil {
+		fmt.Printf("Error: 質問が非存在: %d in getQuestionUserId\n", questionId)
+		return ""
+	}
+	return question.UserId
+}
+
 func getQuestionDocumentPage(db *gorm.DB, questionId int) int {
 	var question Question
 	if err := db.First(&question, "question_id = ?", questionId).Error; err != nil {
@@ -613,7 +680,7 @@ func documentGet(db *gorm.DB, documentId int) (bool, string, string) {
 	return true, *documentUrl, *script
 }
 
-func questionsGet(db *gorm.DB, meetingId int) (bool, int, []int, []string, []int, []int, []string, []string, []int) {
+func questionsGet(db *gorm.DB, meetingId int) (bool, int, []int, []string, []int, []int, []string, []string, []int, []string) {
 	var (
 		layout        = "2006/01/02 15:04:05"
 		location, _   = time.LoadLocation("Asia/Tokyo")
@@ -625,10 +692,11 @@ func questionsGet(db *gorm.DB, meetingId int) (bool, int, []int, []string, []int
 		questionTimes = make([]string, 0, 10)
 		presenterIds  = make([]string, 0, 10)
 		voteNums      = make([]int, 0, 10)
+		statuses      = make([]string, 0, 10)
 	)
-	if db.Table("documents").Select("questions.question_id, questions.question_body, questions.document_id, questions.document_page, questions.question_time, documents.user_id, questions.vote_num").Where("documents.meeting_id = ?", meetingId).Joins("right join questions on documents.document_id = questions.document_id").Scan(&questions); len(questions) == 0 {
+	if db.Table("documents").Select("questions.question_id, questions.question_body, questions.document_id, questions.document_page, questions.question_time, documents.user_id, questions.vote_num, questions.status, questions.question_ok").Where("documents.meeting_id = ? AND (questions.status IS NULL OR questions.status != ?)", meetingId, QuestionStatusPending).Joins("right join questions on documents.document_id = questions.document_id").Scan(&questions); len(questions) == 0 {
 		fmt.Printf("Log: 質問が非存在: %d in questionsGet\n", meetingId)
-		return false, meetingId, []int{}, []string{}, []int{}, []int{}, []string{}, []string{}, []int{}
+		return false, meetingId, []int{}, []string{}, []int{}, []int{}, []string{}, []string{}, []int{}, []string{}
 	}
 	for _, q := range questions {
 		questionIds = append(questionIds, q.QuestionId)
@@ -638,9 +706,10 @@ func questionsGet(db *gorm.DB, meetingId int) (bool, int, []int, []string, []int
 		questionTimes = append(questionTimes, q.QuestionTime.In(location).Format(layout))
 		presenterIds = append(presenterIds, q.UserId)
 		voteNums = append(voteNums, q.VoteNum)
+		statuses = append(statuses, questionStatus(Question{Status: q.Status, QuestionOk: q.QuestionOk}))
 	}
 
-	return true, meetingId, questionIds, questionBodys, documentIds, documentPages, questionTimes, presenterIds, voteNums
+	return true, meetingId, questionIds, questionBodys, documentIds, documentPages, questionTimes, presenterIds, voteNums, statuses
 }
 
 func getPresenterId(db *gorm.DB, documentId int) string {
@@ -652,8 +721,47 @@ func getPresenterId(db *gorm.DB, documentId int) string {
 	return document.UserId
 }
 
-func setMeetingDone(db *gorm.DB, meetingId int) {
+// getPendingMeetings はまだ開始していない会議を返す
+func getPendingMeetings(db *gorm.DB) []Meeting {
+	meetings := make([]Meeting, 0, 10)
+	if err := db.Table("meetings").Select("meetings.*").Joins("left join meeting_states on meetings.meeting_id = meeting_states.meeting_id").Where("meetings.meeting_done = ? AND meetings.meeting_canceled = ? AND (meeting_states.state IS NULL OR meeting_states.state = ?)", false, false, MeetingStateScheduled).Scan(&meetings).Error; err != nil {
+		fmt.Printf("Error: 会議の取得に失敗しました in getPendingMeetings\n")
+	}
+	return meetings
+}
+
+func getMeetingStartTime(db *gorm.DB, meetingId int) (bool, time.Time) {
 	var meeting Meeting
-	db.First(&meeting, "meeting_id = ?", meetingId)
-	db.Model(&meeting).Where("meeting_id = ?", meetingId).Update("meeting_done", true)
+	if err := db.First(&meeting, "meeting_id = ?", meetingId).Error; err != nil {
+		fmt.Printf("Error: 会議が非存在: %d in getMeetingStartTime\n", meetingId)
+		return false, time.Time{}
+	}
+	return true, meeting.MeetingStartTime
+}
+
+func isParticipant(db *gorm.DB, meetingId int, userId string) bool {
+	var participant Participant
+	if err := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, userId).Error; err != nil {
+		fmt.Printf("Log: 参加者が非存在: %d, %s in isParticipant\n", meetingId, userId)
+		return false
+	}
+	return true
+}
+
+func getDocumentMeetingId(db *gorm.DB, documentId int) int {
+	var document Document
+	if err := db.First(&document, "document_id = ?", documentId).Error; err != nil {
+		fmt.Printf("Error: 資料が非存在: %d in getDocumentMeetingId\n", documentId)
+		return -1
+	}
+	return document.MeetingId
+}
+
+func getQuestionMeetingId(db *gorm.DB, questionId int) int {
+	var question Question
+	if err := db.First(&question, "question_id = ?", questionId).Error; err != nil {
+		fmt.Printf("Error: 質問が非存在: %d in getQuestionMeetingId\n", questionId)
+		return -1
+	}
+	return getDocumentMeetingId(db, question.DocumentId)
 }
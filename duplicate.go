@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 質問の本文の類似度(0〜1)の閾値
+const (
+	duplicateSuggestThreshold = 0.5 // 以上なら重複の候補として通知する
+	duplicateGroupThreshold   = 0.8 // 以上なら自動で同じまとまりにする
+)
+
+// SimilarQuestion は投稿された質問と似ている未回答の質問
+type SimilarQuestion struct {
+	QuestionId int     `json:"questionId"`
+	Similarity float64 `json:"similarity"`
+}
+
+// questionClusterId は質問が属するまとまりのIDを返す．まとまりに属さない質問は自身の質問IDとする
+func questionClusterId(question Question) int {
+	if question.ClusterId != 0 {
+		return question.ClusterId
+	}
+	return question.QuestionId
+}
+
+// clusterIdOrNone は通知用のまとまりのIDを返す．まとまりに属さない質問は-1とする
+func clusterIdOrNone(question Question) int {
+	if question.ClusterId != 0 {
+		return question.ClusterId
+	}
+	return -1
+}
+
+// clusterVoteNums はまとまりごとの投票数の合計を返す
+func clusterVoteNums(questions []Question) map[int]int {
+	voteNums := make(map[int]int)
+	for _, question := range questions {
+		voteNums[questionClusterId(question)] += question.VoteNum
+	}
+	return voteNums
+}
+
+// bigrams は空白や記号を除いた本文の文字bigramの集合を返す．1文字の場合はその文字のみとする
+func bigrams(body string) map[string]bool {
+	runes := make([]rune, 0, len(body))
+	for _, r := range strings.ToLower(body) {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		runes = append(runes, r)
+	}
+	set := make(map[string]bool)
+	if len(runes) == 1 {
+		set[string(runes)] = true
+	}
+	for i := 0; i+1 < len(runes); i++ {
+		set[string(runes[i:i+2])] = true
+	}
+	return set
+}
+
+// questionSimilarity は2つの本文の文字bigramのJaccard係数を返す
+func questionSimilarity(a string, b string) float64 {
+	setA, setB := bigrams(a), bigrams(b)
+	if len(setA) == 0 || len(setB) == 0 {
+		return 0
+	}
+	common := 0
+	for gram := range setA {
+		if setB[gram] {
+			common += 1
+		}
+	}
+	return float64(common) / float64(len(setA)+len(setB)-common)
+}
+
+// findSimilarQuestions はquestionと同じ資料の未回答の質問のうち，似ているものを類似度の高い順に返す
+func findSimilarQuestions(db *gorm.DB, question Question) []SimilarQuestion {
+	var (
+		questions = make([]Question, 0, 10)
+		similars  = make([]SimilarQuestion, 0, 10)
+	)
+	db.Order("question_time, question_id").Find(&questions, "document_id = ? AND question_id != ? AND question_ok = ? AND is_voice = ?", question.DocumentId, question.QuestionId, false, false)
+	for _, q := range questions {
+		if similarity := questionSimilarity(question.QuestionBody, q.QuestionBody); similarity >= duplicateSuggestThreshold {
+			similars = append(similars, SimilarQuestion{QuestionId: q.QuestionId, Similarity: similarity})
+		}
+	}
+	sort.SliceStable(similars, func(i, j int) bool { return similars[i].Similarity > similars[j].Similarity })
+	return similars
+}
+
+// groupQuestion は質問questionIdを質問targetIdと同じまとまりにし，まとまりのIDを返す
+func groupQuestion(db *gorm.DB, questionId int, targetId int) (bool, int) {
+	ok, target := getQuestion(db, targetId)
+	if !ok {
+		return false, -1
+	}
+	clusterId := questionClusterId(target)
+	if err := db.Model(&Question{}).Where("question_id IN (?)", []int{questionId, targetId}).Update("cluster_id", clusterId).Error; err != nil {
+		fmt.Printf("Error: update失敗(質問のまとまりの更新に失敗しました): %d, %d in groupQuestion\n", questionId, targetId)
+		return false, -1
+	}
+	fmt.Printf("Log: update成功(質問をまとめました): %d -> %d in groupQuestion\n", questionId, clusterId)
+	return true, clusterId
+}
+
+// getClusterQuestions はまとまりclusterIdに属する質問を返す
+func getClusterQuestions(db *gorm.DB, clusterId int) []Question {
+	questions := make([]Question, 0, 10)
+	if err := db.Order("question_time, question_id").Find(&questions, "cluster_id = ? OR question_id = ?", clusterId, clusterId).Error; err != nil {
+		fmt.Printf("Error: 質問の取得に失敗しました: %d in getClusterQuestions\n", clusterId)
+	}
+	return questions
+}
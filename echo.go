@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/jinzhu/gorm"
@@ -23,14 +26,27 @@ type UserLoginRequest struct {
 }
 
 type UserLoginResult struct {
-	Result   bool   `json:"result"`
-	UserName string `json:"userName"`
+	Result       bool   `json:"result"`
+	UserName     string `json:"userName"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type UserRefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type UserRefreshResult struct {
+	Result       bool   `json:"result"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 }
 
 type CreateMeetingRequest struct {
-	MeetingName      string   `json:"meetingName"`
-	MeetingStartTime string   `json:"meetingStartTime"`
-	PresenterIds     []string `json:"presenterIds"`
+	MeetingName      string                 `json:"meetingName"`
+	MeetingStartTime string                 `json:"meetingStartTime"`
+	PresenterIds     []string               `json:"presenterIds"`
+	Settings         *MeetingSettingRequest `json:"settings"` // 省略した項目は既定値
 }
 
 type CreateMeetingResult struct {
@@ -40,8 +56,7 @@ type CreateMeetingResult struct {
 }
 
 type JoinMeetingRequest struct {
-	UserId    string `json:"userId"`
-	MeetingId int    `json:"meetingId"`
+	MeetingId int `json:"meetingId"`
 }
 
 type JoinMeetingResult struct {
@@ -54,9 +69,8 @@ type JoinMeetingResult struct {
 }
 
 type ExitMeetingRequest struct {
-	UserId     string `json:"userId"`
-	MeetingId  int    `json:"meetingId"`
-	DocumentId int    `json:"documentId"`
+	MeetingId  int `json:"meetingId"`
+	DocumentId int `json:"documentId"`
 }
 
 type ExitMeetingResult struct {
@@ -83,6 +97,174 @@ type DocumentGetResult struct {
 	Script      string `json:"script"`
 }
 
+type MeetingGetRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type MeetingGetResult struct {
+	Result           bool     `json:"result"`
+	MeetingId        int      `json:"meetingId"`
+	MeetingName      string   `json:"meetingName"`
+	MeetingStartTime string   `json:"meetingStartTime"`
+	MeetingDone      bool     `json:"meetingDone"`
+	MeetingCanceled  bool     `json:"meetingCanceled"`
+	PresenterNames   []string `json:"presenterNames"`
+	PresenterIds     []string `json:"presenterIds"`
+	DocumentIds      []int    `json:"documentIds"`
+	Role             string   `json:"role"`
+}
+
+type MeetingListResult struct {
+	Result            bool     `json:"result"`
+	MeetingIds        []int    `json:"meetingIds"`
+	MeetingNames      []string `json:"meetingNames"`
+	MeetingStartTimes []string `json:"meetingStartTimes"`
+	Roles             []string `json:"roles"`
+}
+
+// MeetingUpdateRequest は空の項目を変更しない
+type MeetingUpdateRequest struct {
+	MeetingId        int      `json:"meetingId"`
+	MeetingName      string   `json:"meetingName"`
+	MeetingStartTime string   `json:"meetingStartTime"`
+	PresenterIds     []string `json:"presenterIds"`
+}
+
+type MeetingCancelRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type AgendaReorderRequest struct {
+	MeetingId    int      `json:"meetingId"`
+	PresenterIds []string `json:"presenterIds"`
+}
+
+type AgendaInsertRequest struct {
+	MeetingId   int    `json:"meetingId"`
+	PresenterId string `json:"presenterId"`
+	Position    int    `json:"position"`
+}
+
+type AgendaPostponeRequest struct {
+	MeetingId   int    `json:"meetingId"`
+	PresenterId string `json:"presenterId"`
+}
+
+type MeetingSettingGetRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type MeetingSettingGetResult struct {
+	Result                   bool    `json:"result"`
+	MeetingId                int     `json:"meetingId"`
+	MaxQuestionNum           int     `json:"maxQuestionNum"`
+	ReactionThresholdRatio   float64 `json:"reactionThresholdRatio"`
+	ColdCallEnabled          bool    `json:"coldCallEnabled"`
+	AnonymousQuestionAllowed bool    `json:"anonymousQuestionAllowed"`
+	PresentDurationSec       int     `json:"presentDurationSec"`
+	QuestionDurationSec      int     `json:"questionDurationSec"`
+	QuestionStrategy         string  `json:"questionStrategy"`
+	QuestionApprovalRequired bool    `json:"questionApprovalRequired"`
+	AbsentPresenterGraceSec  int     `json:"absentPresenterGraceSec"`
+}
+
+type MeetingSettingUpdateRequest struct {
+	MeetingId int `json:"meetingId"`
+	MeetingSettingRequest
+}
+
+type MeetingStateGetRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type MeetingStateGetResult struct {
+	Result bool `json:"result"`
+	MeetingStateResult
+}
+
+type MeetingPollRequest struct {
+	MeetingId int    `json:"meetingId"`
+	LastSeq   *int64 `json:"lastSeq"` // 最後に受け取ったメッセージの通し番号(初回は省略)
+}
+
+type MeetingPollResult struct {
+	Result   bool              `json:"result"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// ActionRequest はWeb Socketのメッセージと同じ内容に，対象の会議IDを加えたもの
+type ActionRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+// ActionResult はWeb Socketのackとerrorに相当する．Dataは同じ会議に送信したメッセージ
+type ActionResult struct {
+	Result  bool        `json:"result"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// actionPaths はWeb Socketのメッセージ種別と同じ処理を行うRESTのパス
+var actionPaths = map[string]string{
+	"/question/post":      "question",
+	"/question/vote":      "question_vote",
+	"/meeting/handsup":    "handsup",
+	"/document/reaction":  "reaction",
+	"/meeting/finishword": "finishword",
+	"/hands/reorder":      "hands_reorder",
+	"/hands/clear":        "hands_clear",
+	"/question/edit":      "question_edit",
+	"/question/withdraw":  "question_withdraw",
+	"/question/dismiss":   "question_dismiss",
+	"/question/answered":  "question_answered",
+	"/question/merge":     "question_merge",
+	"/question/approve":   "question_approve",
+	"/question/reject":    "question_reject",
+}
+
+type MyVotesRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type MyVotesResult struct {
+	Result                bool  `json:"result"`
+	QuestionIds           []int `json:"questionIds"`
+	ReactionDocumentIds   []int `json:"reactionDocumentIds"`
+	ReactionDocumentPages []int `json:"reactionDocumentPages"`
+}
+
+type PendingQuestionsRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type PendingQuestionsResult struct {
+	Result    bool             `json:"result"`
+	MeetingId int              `json:"meetingId"`
+	Questions []QuestionResult `json:"questions"`
+}
+
+type MeetingSyncRequest struct {
+	MeetingId int `json:"meetingId"`
+}
+
+type MeetingSyncResult struct {
+	Result bool `json:"result"`
+	SyncResult
+}
+
+// MeetingBreakRequest はisBreakがtrueなら休憩にし，falseなら休憩から再開する
+type MeetingBreakRequest struct {
+	MeetingId int  `json:"meetingId"`
+	IsBreak   bool `json:"isBreak"`
+}
+
+type MeetingRoleRequest struct {
+	MeetingId int    `json:"meetingId"`
+	UserId    string `json:"userId"`
+	Role      string `json:"role"`
+}
+
 type QuestionsGetRequest struct {
 	MeetingId int `json:"meetingId"`
 }
@@ -97,9 +279,10 @@ type QuestionsGetResult struct {
 	QuestionTimes []string `json:"questionTimes"`
 	PresenterIds  []string `json:"presenterIds"`
 	VoteNums      []int    `json:"voteNums"`
+	Statuses      []string `json:"statuses"`
 }
 
-func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
+func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB, auth *Auth, scheduler *Scheduler) {
 
 	e.GET("/", func(c echo.Context) error {
 		serveHome(c.Response(), c.Request())
@@ -125,22 +308,55 @@ func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
 		err := c.Bind(request)
 		if err == nil {
 			resultLogin, userName := loginUser(db, request.UserId, request.UserPassword)
+			token, refreshToken := "", ""
+			if resultLogin {
+				// 以降のAPIとWeb Socketの接続時に提示するトークンを発行
+				resultLogin, token, refreshToken = auth.issueTokens(request.UserId)
+			}
 			result := &UserLoginResult{
-				Result:   resultLogin,
-				UserName: userName,
+				Result:       resultLogin,
+				UserName:     userName,
+				Token:        token,
+				RefreshToken: refreshToken,
 			}
 
 			return c.JSON(http.StatusOK, result)
 		} else {
-			return c.JSON(http.StatusBadRequest, &UserLoginResult{Result: false, UserName: ""})
+			return c.JSON(http.StatusBadRequest, &UserLoginResult{Result: false, UserName: "", Token: "", RefreshToken: ""})
 		}
 	})
 
+	e.POST("/user/refresh", func(c echo.Context) error {
+		request := new(UserRefreshRequest)
+		err := c.Bind(request)
+		if err == nil {
+			resultRefresh, token, refreshToken := auth.refresh(request.RefreshToken)
+			result := &UserRefreshResult{
+				Result:       resultRefresh,
+				Token:        token,
+				RefreshToken: refreshToken,
+			}
+			if !result.Result {
+				return c.JSON(http.StatusUnauthorized, result)
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &UserRefreshResult{Result: false, Token: "", RefreshToken: ""})
+		}
+	})
+
+	e.POST("/user/logout", func(c echo.Context) error {
+		result := &Result{
+			Result: auth.revoke(contextSessionId(c)),
+		}
+		return c.JSON(http.StatusOK, result)
+	}, auth.requireAuth)
+
 	e.POST("/meeting/join", func(c echo.Context) error {
 		request := new(JoinMeetingRequest)
 		err := c.Bind(request)
 		if err == nil {
-			resultJoinMeeting, meetingName, meetingStartTime, presenterNames, presenterIds, documentIds := joinMeeting(db, request.UserId, request.MeetingId)
+			resultJoinMeeting, meetingName, meetingStartTime, presenterNames, presenterIds, documentIds := joinMeeting(db, contextUserId(c), request.MeetingId)
 			layout := "2006/01/02 15:04:05"
 			meetingStartTimeString := meetingStartTime.Format(layout)
 			result := &JoinMeetingResult{
@@ -151,21 +367,21 @@ func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
 				PresenterIds:     presenterIds,
 				DocumentIds:      documentIds,
 			}
-			if result.Result {
-				go hub.sendStartMeetingMessage(request.MeetingId, meetingStartTime)
-			}
 			return c.JSON(http.StatusOK, result)
 		} else {
 			return c.JSON(http.StatusBadRequest, &Result{Result: false})
 		}
 
-	})
+	}, auth.requireAuth)
 
 	e.POST("/meeting/exit", func(c echo.Context) error {
 		request := new(ExitMeetingRequest)
 		err := c.Bind(request)
 		if err == nil {
-			resultExitMeeting := exitMeeting(db, request.UserId, request.MeetingId, request.DocumentId)
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &ExitMeetingResult{Result: false})
+			}
+			resultExitMeeting := exitMeeting(db, contextUserId(c), request.MeetingId, request.DocumentId)
 			result := &ExitMeetingResult{
 				Result: resultExitMeeting,
 			}
@@ -174,34 +390,103 @@ func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
 			return c.JSON(http.StatusBadRequest, &Result{Result: false})
 		}
 
-	})
+	}, auth.requireAuth)
 
 	e.GET("/ws", func(c echo.Context) error {
-		serveWs(hub, c.Response(), c.Request())
+		serveWs(hub, contextUserId(c), c.Response(), c.Request())
 		return nil
-	})
+	}, auth.requireAuth)
+
+	e.GET("/meeting/events", func(c echo.Context) error {
+		return serveEvents(c, hub, contextUserId(c))
+	}, auth.requireAuth)
+
+	e.POST("/meeting/poll", func(c echo.Context) error {
+		request := new(MeetingPollRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			lastSeq := int64(-1)
+			if request.LastSeq != nil && *request.LastSeq >= 0 {
+				lastSeq = *request.LastSeq
+			}
+			result := &MeetingPollResult{
+				Result:   true,
+				Messages: pollMessages(hub, request.MeetingId, contextUserId(c), lastSeq),
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	// Web Socketと同じ処理を行い，同じメッセージを会議に送信する
+	for path, messageType := range actionPaths {
+		messageType := messageType
+		e.POST(path, func(c echo.Context) error {
+			body, err := ioutil.ReadAll(c.Request().Body)
+			request := new(ActionRequest)
+			if err == nil {
+				err = json.Unmarshal(body, request)
+			}
+			if err == nil {
+				if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+					return c.JSON(http.StatusForbidden, &ActionResult{Result: false, Code: ErrorCodeForbidden})
+				}
+				client := &Client{hub: hub, meetingId: request.MeetingId, userId: contextUserId(c), lastSeq: -1}
+				messagestruct, perr := client.dispatch(messageType, body)
+				if perr != nil {
+					fmt.Printf("Error: 処理できませんでした: %s, %s, %s in %s\n", messageType, perr.Code, perr.Message, c.Path())
+					return c.JSON(perr.httpStatus(), &ActionResult{Result: false, Code: perr.Code, Message: perr.Message})
+				}
+				hub.broadcastToRoom(request.MeetingId, messagestruct)
+				return c.JSON(http.StatusOK, &ActionResult{Result: true, Data: messagestruct})
+			} else {
+				return c.JSON(http.StatusBadRequest, &ActionResult{Result: false, Code: ErrorCodeInvalidJson})
+			}
+		}, auth.requireAuth)
+	}
 
 	e.POST("/meeting/create", func(c echo.Context) error {
 		request := new(CreateMeetingRequest)
 		err := c.Bind(request)
 		if err == nil {
-			resultCreateMeeting, meetingId, meetingName := createMeeting(db, request.MeetingName, request.MeetingStartTime, request.PresenterIds)
+			if setting := defaultMeetingSetting(-1); !request.Settings.apply(&setting) {
+				return c.JSON(http.StatusBadRequest, &Result{Result: false})
+			}
+			resultCreateMeeting, meetingId, meetingName := createMeeting(db, contextUserId(c), request.MeetingName, request.MeetingStartTime, request.PresenterIds)
 			result := &CreateMeetingResult{
 				Result:      resultCreateMeeting,
 				MeetingId:   meetingId,
 				MeetingName: meetingName,
 			}
+			if result.Result {
+				if isSaved, _ := updateMeetingSetting(db, meetingId, request.Settings); !isSaved {
+					// 設定を保存できなかった会議は既定の設定で進まないよう中止し，作成の失敗とする
+					cancelMeeting(db, meetingId)
+					return c.JSON(http.StatusOK, &CreateMeetingResult{Result: false, MeetingId: -1, MeetingName: ""})
+				}
+				if isFound, startTime := getMeetingStartTime(db, meetingId); isFound {
+					scheduler.schedule(meetingId, startTime)
+				}
+			}
 
 			return c.JSON(http.StatusOK, result)
 		} else {
 			return c.JSON(http.StatusBadRequest, &Result{Result: false})
 		}
-	})
+	}, auth.requireAuth)
 
 	e.POST("/document/register", func(c echo.Context) error {
 		request := new(DocumentRegisterRequest)
 		err := c.Bind(request)
 		if err == nil {
+			// 資料の登録は資料の持ち主のみ可能
+			if getPresenterId(db, request.DocumentId) != contextUserId(c) {
+				return c.JSON(http.StatusForbidden, &DocumentRegisterResult{Result: false})
+			}
 			resultDocumentRegister, meetingId := documentRegister(db, request.DocumentId, request.DocumentUrl, request.Script)
 			result := &DocumentRegisterResult{
 				Result: resultDocumentRegister,
@@ -213,12 +498,15 @@ func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
 		} else {
 			return c.JSON(http.StatusBadRequest, &Result{Result: false})
 		}
-	})
+	}, auth.requireAuth)
 
 	e.POST("/document/get", func(c echo.Context) error {
 		request := new(DocumentGetRequest)
 		err := c.Bind(request)
 		if err == nil {
+			if !isParticipant(db, getDocumentMeetingId(db, request.DocumentId), contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &DocumentGetResult{Result: false, DocumentUrl: "", Script: ""})
+			}
 			resultDocumentGet, documentUrl, script := documentGet(db, request.DocumentId)
 			result := &DocumentGetResult{
 				Result:      resultDocumentGet,
@@ -229,13 +517,16 @@ func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
 		} else {
 			return c.JSON(http.StatusBadRequest, &Result{Result: false})
 		}
-	})
+	}, auth.requireAuth)
 
 	e.POST("/questions", func(c echo.Context) error {
 		request := new(QuestionsGetRequest)
 		err := c.Bind(request)
 		if err == nil {
-			resultQuestionsGet, meetingId, questionIds, questionBodys, documentIds, documentPages, questionTimes, presenterIds, voteNums := questionsGet(db, request.MeetingId)
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &QuestionsGetResult{Result: false, MeetingId: request.MeetingId})
+			}
+			resultQuestionsGet, meetingId, questionIds, questionBodys, documentIds, documentPages, questionTimes, presenterIds, voteNums, statuses := questionsGet(db, request.MeetingId)
 			result := &QuestionsGetResult{
 				Result:        resultQuestionsGet,
 				MeetingId:     meetingId,
@@ -246,10 +537,349 @@ func initRouting(e *echo.Echo, hub *Hub, db *gorm.DB) {
 				QuestionTimes: questionTimes,
 				PresenterIds:  presenterIds,
 				VoteNums:      voteNums,
+				Statuses:      statuses,
 			}
 			return c.JSON(http.StatusOK, result)
 		} else {
 			return c.JSON(http.StatusBadRequest, &Result{Result: false})
 		}
-	})
+	}, auth.requireAuth)
+
+	e.POST("/meeting/role", func(c echo.Context) error {
+		request := new(MeetingRoleRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 役割の割り当ては主催者のみ可能
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			if !isAssignableRole(request.Role) {
+				return c.JSON(http.StatusBadRequest, &Result{Result: false})
+			}
+			result := &Result{
+				Result: setParticipantRole(db, request.MeetingId, request.UserId, request.Role),
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/get", func(c echo.Context) error {
+		request := new(MeetingGetRequest)
+		err := c.Bind(request)
+		if err == nil {
+			isParticipant, role := getParticipantRole(db, request.MeetingId, contextUserId(c))
+			if !isParticipant {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			isFound, meeting := getMeeting(db, request.MeetingId)
+			_, presenterNames, presenterIds, documentIds := getPresenters(db, request.MeetingId)
+			layout := "2006/01/02 15:04:05"
+			result := &MeetingGetResult{
+				Result:           isFound,
+				MeetingId:        meeting.MeetingId,
+				MeetingName:      meeting.MeetingName,
+				MeetingStartTime: meeting.MeetingStartTime.Format(layout),
+				MeetingDone:      meeting.MeetingDone,
+				MeetingCanceled:  meeting.MeetingCanceled,
+				PresenterNames:   presenterNames,
+				PresenterIds:     presenterIds,
+				DocumentIds:      documentIds,
+				Role:             role,
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/list", func(c echo.Context) error {
+		var (
+			layout            = "2006/01/02 15:04:05"
+			userId            = contextUserId(c)
+			meetingIds        = make([]int, 0, 10)
+			meetingNames      = make([]string, 0, 10)
+			meetingStartTimes = make([]string, 0, 10)
+			roles             = make([]string, 0, 10)
+		)
+		for _, meeting := range listMeetings(db, userId) {
+			_, role := getParticipantRole(db, meeting.MeetingId, userId)
+			meetingIds = append(meetingIds, meeting.MeetingId)
+			meetingNames = append(meetingNames, meeting.MeetingName)
+			meetingStartTimes = append(meetingStartTimes, meeting.MeetingStartTime.Format(layout))
+			roles = append(roles, role)
+		}
+		result := &MeetingListResult{
+			Result:            true,
+			MeetingIds:        meetingIds,
+			MeetingNames:      meetingNames,
+			MeetingStartTimes: meetingStartTimes,
+			Roles:             roles,
+		}
+		return c.JSON(http.StatusOK, result)
+	}, auth.requireAuth)
+
+	e.POST("/meeting/update", func(c echo.Context) error {
+		request := new(MeetingUpdateRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 会議の変更は主催者のみ可能
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			if isFound, meeting := getMeeting(db, request.MeetingId); !isFound || meeting.MeetingCanceled {
+				return c.JSON(http.StatusOK, &Result{Result: false})
+			}
+			resultUpdateMeeting := true
+			// 変更できた項目がある場合のみ参加者に通知する
+			isChanged := false
+			if request.MeetingName != "" {
+				isUpdated := updateMeetingName(db, request.MeetingId, request.MeetingName)
+				resultUpdateMeeting = isUpdated && resultUpdateMeeting
+				isChanged = isUpdated || isChanged
+			}
+			if request.MeetingStartTime != "" {
+				isUpdated, startTime := updateMeetingStartTime(db, request.MeetingId, request.MeetingStartTime)
+				if isUpdated {
+					scheduler.schedule(request.MeetingId, startTime)
+				}
+				resultUpdateMeeting = isUpdated && resultUpdateMeeting
+				isChanged = isUpdated || isChanged
+			}
+			if len(request.PresenterIds) != 0 {
+				isUpdated := updatePresenters(db, request.MeetingId, request.PresenterIds)
+				resultUpdateMeeting = isUpdated && resultUpdateMeeting
+				isChanged = isUpdated || isChanged
+			}
+			if isChanged {
+				hub.sendMeetingUpdate(request.MeetingId)
+			}
+			return c.JSON(http.StatusOK, &Result{Result: resultUpdateMeeting})
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/cancel", func(c echo.Context) error {
+		request := new(MeetingCancelRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 会議の中止は主催者のみ可能
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			// 進行中の会議は先に終了状態にする(中止後は状態を遷移できないため)
+			state := getMeetingState(db, request.MeetingId)
+			if state.State != MeetingStateScheduled && state.State != MeetingStateEnded {
+				ok, ended := transitMeetingState(db, request.MeetingId, MeetingState{State: MeetingStateEnded, PresentOrder: -1})
+				if !ok {
+					return c.JSON(http.StatusOK, &Result{Result: false})
+				}
+				hub.sendMeetingState(ended)
+			}
+			result := &Result{
+				Result: cancelMeeting(db, request.MeetingId),
+			}
+			if result.Result {
+				scheduler.cancel(request.MeetingId)
+				hub.progress.stop(request.MeetingId)
+				hub.sendMeetingUpdate(request.MeetingId)
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/agenda/reorder", func(c echo.Context) error {
+		request := new(AgendaReorderRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 発表順の変更は主催者と共同司会者のみ可能
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer, RoleModerator) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			result := &Result{
+				Result: reorderPresenters(db, request.MeetingId, request.PresenterIds),
+			}
+			if result.Result {
+				hub.sendAgenda(request.MeetingId)
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/agenda/insert", func(c echo.Context) error {
+		request := new(AgendaInsertRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer, RoleModerator) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			result := &Result{
+				Result: insertPresenter(db, request.MeetingId, request.PresenterId, request.Position),
+			}
+			if result.Result {
+				hub.sendAgenda(request.MeetingId)
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/agenda/postpone", func(c echo.Context) error {
+		request := new(AgendaPostponeRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer, RoleModerator) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			result := &Result{
+				Result: postponePresenter(db, request.MeetingId, request.PresenterId),
+			}
+			if result.Result {
+				hub.sendAgenda(request.MeetingId)
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/settings/get", func(c echo.Context) error {
+		request := new(MeetingSettingGetRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			setting := getMeetingSetting(db, request.MeetingId)
+			result := &MeetingSettingGetResult{
+				Result:                   true,
+				MeetingId:                setting.MeetingId,
+				MaxQuestionNum:           setting.MaxQuestionNum,
+				ReactionThresholdRatio:   setting.ReactionThresholdRatio,
+				ColdCallEnabled:          setting.ColdCallEnabled,
+				AnonymousQuestionAllowed: setting.AnonymousQuestionAllowed,
+				PresentDurationSec:       setting.PresentDurationSec,
+				QuestionDurationSec:      setting.QuestionDurationSec,
+				QuestionStrategy:         getQuestionStrategyName(setting.QuestionStrategy),
+				QuestionApprovalRequired: setting.QuestionApprovalRequired,
+				AbsentPresenterGraceSec:  getAbsentPresenterGraceSec(setting),
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/settings/update", func(c echo.Context) error {
+		request := new(MeetingSettingUpdateRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 設定の変更は主催者のみ可能
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			resultUpdateSetting, setting := updateMeetingSetting(db, request.MeetingId, &request.MeetingSettingRequest)
+			if resultUpdateSetting {
+				hub.sendMeetingSetting(setting)
+			}
+			return c.JSON(http.StatusOK, &Result{Result: resultUpdateSetting})
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/state", func(c echo.Context) error {
+		request := new(MeetingStateGetRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			result := &MeetingStateGetResult{
+				Result:             true,
+				MeetingStateResult: newMeetingStateResult(getMeetingState(db, request.MeetingId)),
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/sync", func(c echo.Context) error {
+		request := new(MeetingSyncRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			result := &MeetingSyncResult{
+				Result:     true,
+				SyncResult: getSync(db, hub, request.MeetingId, contextUserId(c)),
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/myvotes", func(c echo.Context) error {
+		request := new(MyVotesRequest)
+		err := c.Bind(request)
+		if err == nil {
+			if !isParticipant(db, request.MeetingId, contextUserId(c)) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			questionIds, documentIds, documentPages := getMyVotes(db, request.MeetingId, contextUserId(c))
+			result := &MyVotesResult{
+				Result:                true,
+				QuestionIds:           questionIds,
+				ReactionDocumentIds:   documentIds,
+				ReactionDocumentPages: documentPages,
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/questions/pending", func(c echo.Context) error {
+		request := new(PendingQuestionsRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 承認待ちの質問は主催者と共同司会者のみ閲覧できる
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer, RoleModerator) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			result := &PendingQuestionsResult{
+				Result:    true,
+				MeetingId: request.MeetingId,
+				Questions: getPendingQuestionResults(db, request.MeetingId),
+			}
+			return c.JSON(http.StatusOK, result)
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
+
+	e.POST("/meeting/break", func(c echo.Context) error {
+		request := new(MeetingBreakRequest)
+		err := c.Bind(request)
+		if err == nil {
+			// 休憩と再開は主催者と司会のみ可能
+			if !hasRole(db, request.MeetingId, contextUserId(c), RoleOrganizer, RoleModerator) {
+				return c.JSON(http.StatusForbidden, &Result{Result: false})
+			}
+			resultBreak, _ := hub.progress.setBreak(request.MeetingId, request.IsBreak)
+			return c.JSON(http.StatusOK, &Result{Result: resultBreak})
+		} else {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}, auth.requireAuth)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Web Socketが使えない環境向けに，/wsと同じ会議のメッセージをServer-Sent Eventsとロングポーリングで配信する
+
+// 1回のロングポーリングでメッセージを待つ最長の時間
+const pollWait = 25 * time.Second
+
+// newFeedClient はWeb Socketを持たないClientを作り，Hubに登録する．
+// 登録するとlastSeqより後のメッセージか，会議の最新の状態が送られる．
+func newFeedClient(hub *Hub, meetingId int, userId string, lastSeq int64) *Client {
+	client := &Client{hub: hub, send: make(chan []byte, 256), meetingId: meetingId, userId: userId, lastSeq: lastSeq}
+	hub.register <- client
+	return client
+}
+
+// seqOf はメッセージに付けられた通し番号を返す．通し番号のないメッセージはfalseを返す
+func seqOf(data []byte) (int64, bool) {
+	var message struct {
+		Seq *int64 `json:"seq"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil || message.Seq == nil {
+		return 0, false
+	}
+	return *message.Seq, true
+}
+
+// serveEvents はServer-Sent Eventsで会議のメッセージを配信する．
+// EventSourceの再接続時にはLast-Event-IDから続きを送る．
+func serveEvents(c echo.Context, hub *Hub, userId string) error {
+	meetingId, err := strconv.Atoi(c.QueryParam("meetingId"))
+	if err != nil {
+		fmt.Printf("Error: 会議IDが不正です: %s in serveEvents\n", c.QueryParam("meetingId"))
+		return c.JSON(http.StatusBadRequest, &Result{Result: false})
+	}
+	if !isParticipant(db, meetingId, userId) {
+		return c.JSON(http.StatusForbidden, &Result{Result: false})
+	}
+	lastSeq := int64(-1)
+	lastSeqStr := c.Request().Header.Get("Last-Event-ID")
+	if lastSeqStr == "" {
+		lastSeqStr = c.QueryParam("lastSeq")
+	}
+	if lastSeqStr != "" {
+		if lastSeq, err = strconv.ParseInt(lastSeqStr, 10, 64); err != nil || lastSeq < 0 {
+			return c.JSON(http.StatusBadRequest, &Result{Result: false})
+		}
+	}
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	client := newFeedClient(hub, meetingId, userId, lastSeq)
+	defer func() {
+		hub.unregister <- client
+		fmt.Println("Warning: Server-Sent EventsをCloseしました in serveEvents")
+	}()
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// The hub closed the channel.
+				return nil
+			}
+			if seq, ok := seqOf(message); ok {
+				fmt.Fprintf(response, "id: %d\n", seq)
+			}
+			fmt.Fprintf(response, "data: %s\n\n", message)
+			response.Flush()
+		case <-ticker.C:
+			// プロキシに切断されないよう定期的にコメントを送る
+			fmt.Fprint(response, ": ping\n\n")
+			response.Flush()
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// pollMessages はlastSeqより後のメッセージを返す．まだなければpollWaitまで届くのを待つ
+func pollMessages(hub *Hub, meetingId int, userId string, lastSeq int64) []json.RawMessage {
+	messages := make([]json.RawMessage, 0, 10)
+	client := newFeedClient(hub, meetingId, userId, lastSeq)
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+	select {
+	case message, ok := <-client.send:
+		if !ok {
+			return messages
+		}
+		messages = append(messages, message)
+	case <-timer.C:
+		return messages
+	}
+	// 既に届いているメッセージもまとめて返す
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 挙手は発表者の資料ごとの待ち行列になっており，Question.QueuePositionの小さい順に当てる
+
+// HandQueueResult は挙手の待ち行列を参加者に通知するメッセージ．UserIdsは当てられる順
+type HandQueueResult struct {
+	MessageType string   `json:"messageType"`
+	MeetingId   int      `json:"meetingId"`
+	DocumentId  int      `json:"documentId"`
+	PresenterId string   `json:"presenterId"`
+	UserIds     []string `json:"userIds"`
+}
+
+// getHandQueue は資料への挙手を当てられる順に返す
+func getHandQueue(db *gorm.DB, documentId int) []Question {
+	hands := make([]Question, 0, 10)
+	if err := db.Order("queue_position, question_time, question_id").Find(&hands, "document_id = ? AND question_ok = ? AND is_voice = ?", documentId, false, true).Error; err != nil {
+		fmt.Printf("Error: 挙手の取得に失敗しました: %d in getHandQueue\n", documentId)
+	}
+	return hands
+}
+
+func getHandQueueUserIds(db *gorm.DB, documentId int) []string {
+	userIds := make([]string, 0, 10)
+	for _, hand := range getHandQueue(db, documentId) {
+		userIds = append(userIds, hand.UserId)
+	}
+	return userIds
+}
+
+// getHandPosition はユーザーの待ち行列での順番(1から)を返す．挙手していない場合は0
+func getHandPosition(userIds []string, userId string) int {
+	for i, id := range userIds {
+		if id == userId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// nextHandPosition は待ち行列の最後尾の位置を返す
+func nextHandPosition(db *gorm.DB, documentId int) int {
+	hands := getHandQueue(db, documentId)
+	if len(hands) == 0 {
+		return 1
+	}
+	return hands[len(hands)-1].QueuePosition + 1
+}
+
+// reorderHands は挙手の待ち行列をuserIdsの順に並べ替える．userIdsは挙手中の参加者全員である必要がある
+func reorderHands(db *gorm.DB, documentId int, userIds []string) bool {
+	hands := getHandQueue(db, documentId)
+	if len(hands) != len(userIds) {
+		fmt.Printf("Error: 挙手中の参加者と一致しません: %d, %v in reorderHands\n", documentId, userIds)
+		return false
+	}
+	handIds := make(map[string]int)
+	for _, hand := range hands {
+		handIds[hand.UserId] = hand.QuestionId
+	}
+
+	tx := db.Begin()
+	for i, userId := range userIds {
+		questionId, ok := handIds[userId]
+		if !ok {
+			tx.Rollback()
+			fmt.Printf("Error: 挙手していない参加者です: %d, %s in reorderHands\n", documentId, userId)
+			return false
+		}
+		delete(handIds, userId)
+		if err := tx.Model(&Question{}).Where("question_id = ?", questionId).Update("queue_position", i+1).Error; err != nil {
+			tx.Rollback()
+			fmt.Printf("Error: update失敗(挙手の順番の更新に失敗しました): %d, %s in reorderHands\n", documentId, userId)
+			return false
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		fmt.Printf("Error: commit失敗(挙手の並べ替えに失敗しました): %d in reorderHands\n", documentId)
+		return false
+	}
+	fmt.Printf("Log: update成功(挙手を並べ替えました): %d, %v in reorderHands\n", documentId, userIds)
+	return true
+}
+
+// clearHands は資料への挙手を全て下ろす
+func clearHands(db *gorm.DB, documentId int) bool {
+	if err := db.Where("document_id = ? AND question_ok = ? AND is_voice = ?", documentId, false, true).Delete(&Question{}).Error; err != nil {
+		fmt.Printf("Error: delete失敗(挙手の取り消しに失敗しました): %d in clearHands\n", documentId)
+		return false
+	}
+	fmt.Printf("Log: delete成功(挙手を全て取り消しました): %d in clearHands\n", documentId)
+	return true
+}
+
+func newHandQueueResult(db *gorm.DB, meetingId int, documentId int) HandQueueResult {
+	return HandQueueResult{
+		MessageType: "hand_queue",
+		MeetingId:   meetingId,
+		DocumentId:  documentId,
+		PresenterId: getPresenterId(db, documentId),
+		UserIds:     getHandQueueUserIds(db, documentId),
+	}
+}
+
+// sendHandQueue は挙手の待ち行列を参加者に通知する
+func (hub *Hub) sendHandQueue(meetingId int, documentId int) {
+	hub.broadcastToRoom(meetingId, newHandQueueResult(db, meetingId, documentId))
+}
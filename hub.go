@@ -4,31 +4,104 @@
 
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+// 会議ごとに再送用に保持するメッセージの数
+const messageLogSize = 256
+
+// Hub maintains the set of active clients per meeting and broadcasts
+// messages to the clients of the same meeting.
 type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
+	// Registered clients, grouped by meeting id.
+	rooms map[int]map[*Client]bool
 
 	// Inbound messages from the clients.
-	broadcast chan []byte
+	broadcast chan *RoomMessage
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// 特定のclientのみに送るメッセージ
+	direct chan *ClientMessage
+
+	// runの外で作った最新の状態
+	syncs chan *SyncSnapshot
+
+	// 全てのノードのHubにメッセージを配信する
+	broker Broker
+
+	// 会議ごとの最後に受け取ったメッセージの通し番号と，再送用の直近のメッセージ．
+	// runのゴルーチンのみが読み書きする．
+	seqs map[int]int64
+	logs map[int][]*RoomMessage
+
+	// 会議ごとの，通し番号のメッセージが届くまで送信を待っている個別のメッセージ．
+	// runのゴルーチンのみが読み書きする．
+	pending map[int][]*ClientMessage
+
+	// 会議の進行と制限時間の管理
+	progress *Progress
+}
+
+// ClientMessage is a message addressed to a single client.
+type ClientMessage struct {
+	Client *Client
+	Data   []byte
+	Seq    int64 // 0より大きい場合は，この通し番号のメッセージを送った後に送る
 }
 
-func newHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
+// SyncSnapshot はclientに送る最新の状態．DBを読むためrunの外で作る
+type SyncSnapshot struct {
+	Client *Client
+	Data   []byte
+	Seq    int64 // 作り始めた時点で届いていた最後の通し番号
+}
+
+// RoomMessage is a message addressed to every client of one meeting.
+type RoomMessage struct {
+	MeetingId   int
+	Data        []byte
+	Seq         int64    // Brokerが振る会議ごとの通し番号
+	IsEphemeral bool     // 残り時間の通知など，通し番号を振らず再送もしないメッセージ
+	UserIds     []string // 宛先を限定する場合の参加者．空の場合は会議の全員に送る
+}
+
+// RestrictedMessage は宛先を限定するメッセージ．broadcastToRoomに渡すとUserIdsの参加者にのみ送信する
+type RestrictedMessage struct {
+	UserIds []string
+	Message interface{}
+}
+
+// MarshalJSON は宛先を除いたメッセージ本体をJSONに変換する
+func (m RestrictedMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Message)
+}
+
+func newHub(clock Clock, broker Broker) *Hub {
+	hub := &Hub{
+		broker:     broker,
+		broadcast:  make(chan *RoomMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		direct:     make(chan *ClientMessage),
+		syncs:      make(chan *SyncSnapshot),
+		rooms:      make(map[int]map[*Client]bool),
+		seqs:       make(map[int]int64),
+		logs:       make(map[int][]*RoomMessage),
+		pending:    make(map[int][]*ClientMessage),
 	}
+	hub.progress = newProgress(clock, hub)
+	// 他のノードからのメッセージも含め，配信されたメッセージをrunで送信する
+	broker.Subscribe(func(message *RoomMessage) {
+		hub.broadcast <- message
+	})
+	return hub
 }
 
 func (h *Hub) run() {
@@ -36,23 +109,269 @@ func (h *Hub) run() {
 		// 種別によって場合分け(登録，削除，ブロードキャスト)
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			room, ok := h.rooms[client.meetingId]
+			if !ok {
+				room = make(map[*Client]bool)
+				h.rooms[client.meetingId] = room
+			}
+			room[client] = true
+			// 取りこぼしたメッセージを再送できなければ最新の状態を送る．
+			// 状態はDBから読むため別のゴルーチンで作り，作り終えるまでこのclientへの配信を保留する
+			if !h.replay(client) {
+				client.isSyncing = true
+				go h.buildSync(client, h.seqs[client.meetingId])
+			}
+		case snapshot := <-h.syncs:
+			if _, ok := h.rooms[snapshot.Client.meetingId][snapshot.Client]; ok {
+				snapshot.Client.isSyncing = false
+				h.sendSnapshot(snapshot)
+			}
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-				fmt.Println("Warning: unregisterによりWeb SocketをCloseしました in run(hub.go)")
+			if room, ok := h.rooms[client.meetingId]; ok {
+				if _, ok := room[client]; ok {
+					h.removeClient(client)
+					fmt.Println("Warning: unregisterによりWeb SocketをCloseしました in run(hub.go)")
+				}
 			}
+		case message := <-h.direct:
+			meetingId := message.Client.meetingId
+			if message.Seq > h.seqs[meetingId] {
+				// 対応するメッセージがまだ届いていないため，届いてから送る
+				h.pending[meetingId] = append(h.pending[meetingId], message)
+				continue
+			}
+			h.sendDirect(message)
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					fmt.Println("Warning: broadcastによりWeb SocketをCloseしました in run(hub.go)")
-					delete(h.clients, client)
+			if !message.IsEphemeral {
+				if message.Seq > h.seqs[message.MeetingId] {
+					h.seqs[message.MeetingId] = message.Seq
 				}
+				message.Data = withSeq(message.Data, message.Seq)
+				h.appendLog(message)
 			}
+			h.broadcastMessage(message)
+			h.flushPending(message.MeetingId)
+		}
+	}
+}
+
+// broadcastMessage はmessageを会議の参加者に送信する
+func (h *Hub) broadcastMessage(message *RoomMessage) {
+	for client := range h.rooms[message.MeetingId] {
+		// 最新の状態を作っている間のメッセージは，状態を送った後に再送する
+		if client.isSyncing {
+			continue
+		}
+		if len(message.UserIds) != 0 && !containsUserId(message.UserIds, client.userId) {
+			continue
+		}
+		select {
+		case client.send <- message.Data:
+		default:
+			h.removeClient(client)
+			fmt.Println("Warning: broadcastによりWeb SocketをCloseしました in run(hub.go)")
+		}
+	}
+}
+
+// sendDirect はclientが会議に参加している場合にのみmessageを送信する．
+// 通し番号の指定がない場合は，その時点で届いている最後の通し番号を付ける
+func (h *Hub) sendDirect(message *ClientMessage) {
+	meetingId := message.Client.meetingId
+	if _, ok := h.rooms[meetingId][message.Client]; !ok {
+		return
+	}
+	seq := message.Seq
+	if seq == 0 {
+		seq = h.seqs[meetingId]
+	}
+	select {
+	case message.Client.send <- withSeq(message.Data, seq):
+	default:
+		h.removeClient(message.Client)
+		fmt.Println("Warning: directによりWeb SocketをCloseしました in run(hub.go)")
+	}
+}
+
+// flushPending は対応するメッセージが届いた個別のメッセージを送信する
+func (h *Hub) flushPending(meetingId int) {
+	waiting := h.pending[meetingId][:0]
+	for _, message := range h.pending[meetingId] {
+		if message.Seq > h.seqs[meetingId] {
+			waiting = append(waiting, message)
+			continue
+		}
+		h.sendDirect(message)
+	}
+	if len(waiting) == 0 {
+		delete(h.pending, meetingId)
+		return
+	}
+	h.pending[meetingId] = waiting
+}
+
+// removeClient はclientを会議の部屋から取り除き，空になった部屋を削除する
+func (h *Hub) removeClient(client *Client) {
+	room := h.rooms[client.meetingId]
+	delete(room, client)
+	close(client.send)
+	if len(room) == 0 {
+		delete(h.rooms, client.meetingId)
+	}
+}
+
+// appendLog はmessageを再送用に保持し，古いものから捨てる
+func (h *Hub) appendLog(message *RoomMessage) {
+	log := append(h.logs[message.MeetingId], message)
+	if len(log) > messageLogSize {
+		log = log[len(log)-messageLogSize:]
+	}
+	h.logs[message.MeetingId] = log
+}
+
+// replay はclientが最後に受け取った通し番号より後のメッセージを再送する．
+// 通し番号の指定がない，もしくは再送に必要なメッセージが既に捨てられている場合はfalseを返す．
+func (h *Hub) replay(client *Client) bool {
+	if client.lastSeq < 0 || client.lastSeq > h.seqs[client.meetingId] {
+		return false
+	}
+	log := h.logs[client.meetingId]
+	if len(log) > 0 && log[0].Seq > client.lastSeq+1 {
+		fmt.Printf("Log: 再送できないメッセージがあります: %d, %d in replay\n", client.meetingId, client.lastSeq)
+		return false
+	}
+	if len(log) == 0 && client.lastSeq != h.seqs[client.meetingId] {
+		return false
+	}
+	for _, message := range log {
+		if message.Seq <= client.lastSeq {
+			continue
+		}
+		select {
+		case client.send <- message.Data:
+		default:
+			h.removeClient(client)
+			fmt.Println("Warning: replayによりWeb SocketをCloseしました in run(hub.go)")
+			return true
+		}
+	}
+	fmt.Printf("Log: メッセージを再送しました: %d, %d -> %d in replay\n", client.meetingId, client.lastSeq, h.seqs[client.meetingId])
+	return true
+}
+
+// buildSync はclientに送る最新の状態を作り，runに渡す
+func (h *Hub) buildSync(client *Client, seq int64) {
+	data, err := json.Marshal(getSync(db, h, client.meetingId, client.userId))
+	if err != nil {
+		fmt.Printf("Error: JSONへの変換に失敗しました: %d in buildSync\n", client.meetingId)
+		data = nil
+	}
+	h.syncs <- &SyncSnapshot{Client: client, Data: data, Seq: seq}
+}
+
+// sendSnapshot は最新の状態を送り，作っている間に届いたメッセージを続けて送る
+func (h *Hub) sendSnapshot(snapshot *SyncSnapshot) {
+	client := snapshot.Client
+	messages := make([][]byte, 0, 10)
+	if snapshot.Data != nil {
+		messages = append(messages, withSeq(snapshot.Data, snapshot.Seq))
+	}
+	for _, message := range h.logs[client.meetingId] {
+		if message.Seq > snapshot.Seq {
+			messages = append(messages, message.Data)
+		}
+	}
+	for _, data := range messages {
+		select {
+		case client.send <- data:
+		default:
+			h.removeClient(client)
+			fmt.Println("Warning: sendSnapshotによりWeb SocketをCloseしました in run(hub.go)")
+			return
+		}
+	}
+}
+
+// withSeq はJSONのオブジェクトに通し番号seqを追加する
+func withSeq(data []byte, seq int64) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	if len(data) == 2 {
+		return []byte(fmt.Sprintf(`{"seq":%d}`, seq))
+	}
+	return append([]byte(fmt.Sprintf(`{"seq":%d,`, seq)), data[1:]...)
+}
+
+// broadcastToRoom はmessageをJSONに変換し，meetingIdの会議に参加しているclientにのみ送信する．
+// RestrictedMessageの場合は宛先の参加者にのみ送信し，見えない参加者がいるため通し番号を振らない．
+// Brokerが振った通し番号を返す．通し番号を振らなかった場合や配信に失敗した場合は0
+func (h *Hub) broadcastToRoom(meetingId int, message interface{}) int64 {
+	if restricted, ok := message.(RestrictedMessage); ok {
+		h.broadcastToUsers(meetingId, restricted.UserIds, restricted.Message)
+		return 0
+	}
+	messagejson, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Error: JSONへの変換に失敗しました: %+v in broadcastToRoom\n", message)
+		return 0
+	}
+	roomMessage := &RoomMessage{MeetingId: meetingId, Data: messagejson}
+	if err := h.broker.Publish(roomMessage); err != nil {
+		fmt.Printf("Error: メッセージの配信に失敗しました: %d in broadcastToRoom\n", meetingId)
+		return 0
+	}
+	return roomMessage.Seq
+}
+
+// broadcastEphemeral はbroadcastToRoomと同様に送信するが，通し番号を振らず再送の対象にもしない
+func (h *Hub) broadcastEphemeral(meetingId int, message interface{}) {
+	messagejson, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Error: JSONへの変換に失敗しました: %+v in broadcastEphemeral\n", message)
+		return
+	}
+	if err := h.broker.Publish(&RoomMessage{MeetingId: meetingId, Data: messagejson, IsEphemeral: true}); err != nil {
+		fmt.Printf("Error: メッセージの配信に失敗しました: %d in broadcastEphemeral\n", meetingId)
+	}
+}
+
+// broadcastToUsers はmessageをJSONに変換し，meetingIdの会議に参加しているuserIdsの参加者にのみ送信する
+func (h *Hub) broadcastToUsers(meetingId int, userIds []string, message interface{}) {
+	if len(userIds) == 0 {
+		return
+	}
+	messagejson, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Error: JSONへの変換に失敗しました: %+v in broadcastToUsers\n", message)
+		return
+	}
+	if err := h.broker.Publish(&RoomMessage{MeetingId: meetingId, Data: messagejson, IsEphemeral: true, UserIds: userIds}); err != nil {
+		fmt.Printf("Error: メッセージの配信に失敗しました: %d in broadcastToUsers\n", meetingId)
+	}
+}
+
+func containsUserId(userIds []string, userId string) bool {
+	for _, id := range userIds {
+		if id == userId {
+			return true
 		}
 	}
+	return false
+}
+
+// sendToClient はmessageをJSONに変換し，clientにのみ送信する
+func (h *Hub) sendToClient(client *Client, message interface{}) {
+	h.sendToClientAfter(client, message, 0)
+}
+
+// sendToClientAfter はsendToClientと同様に送信するが，通し番号seqのメッセージをclientに送った後に，
+// seqを付けて送る．seqが0の場合は順序を保証せず，その時点で届いている最後の通し番号を付ける
+func (h *Hub) sendToClientAfter(client *Client, message interface{}, seq int64) {
+	messagejson, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Error: JSONへの変換に失敗しました: %+v in sendToClient\n", message)
+		return
+	}
+	h.direct <- &ClientMessage{Client: client, Data: messagejson, Seq: seq}
 }
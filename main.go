@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo"
@@ -44,7 +45,8 @@ func main() {
 		port = "8080"
 	}
 
-	hub := newHub()
+	// 例: REDIS_URL=redis://localhost:6379 (複数のプロセスで動かす場合に設定する)
+	hub := newHub(realClock{}, newBroker())
 	// startEcho()
 	go hub.run() // hubのゴルーチン開始
 
@@ -55,8 +57,20 @@ func main() {
 	db := connectDB()
 
 	dbsetting(db)
+	migrateDB(db)
 
-	initRouting(e, hub, db)
+	auth := newAuth(db)
+
+	// 進行中の会議の制限時間を戻す(再起動時に発表や質疑応答が止まったままにならないようにする)
+	hub.progress.loadPhases(db)
+
+	// 会議開始の通知を予約(再起動時は未開始の会議を読み込み直す)
+	scheduler := newScheduler(realClock{}, func(meetingId int) (bool, time.Time) {
+		return getMeetingStartTime(db, meetingId)
+	}, hub.sendStartMeetingMessage)
+	scheduler.loadPending(db)
+
+	initRouting(e, hub, db, auth, scheduler)
 
 	fmt.Println("End main func.")
 	// e.Logger.Fatal(e.Start(":1323"))
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MeetingUpdateResult は会議の内容が変更されたことを参加者に通知するメッセージ
+type MeetingUpdateResult struct {
+	MessageType      string   `json:"messageType"`
+	MeetingId        int      `json:"meetingId"`
+	MeetingName      string   `json:"meetingName"`
+	MeetingStartTime string   `json:"meetingStartTime"`
+	MeetingCanceled  bool     `json:"meetingCanceled"`
+	PresenterNames   []string `json:"presenterNames"`
+	PresenterIds     []string `json:"presenterIds"`
+	DocumentIds      []int    `json:"documentIds"`
+}
+
+func getMeeting(db *gorm.DB, meetingId int) (bool, Meeting) {
+	var meeting Meeting
+	if err := db.First(&meeting, "meeting_id = ?", meetingId).Error; err != nil {
+		fmt.Printf("Error: 会議が非存在: %d in getMeeting\n", meetingId)
+		return false, Meeting{}
+	}
+	return true, meeting
+}
+
+// listMeetings はユーザーが参加者として登録されている，終了も中止もしていない会議を開始時刻順に返す
+func listMeetings(db *gorm.DB, userId string) []Meeting {
+	meetings := make([]Meeting, 0, 10)
+	if err := db.Table("meetings").Select("meetings.*").Joins("inner join participants on meetings.meeting_id = participants.meeting_id").Where("participants.user_id = ? AND meetings.meeting_done = ? AND meetings.meeting_canceled = ?", userId, false, false).Order("meetings.meeting_start_time").Scan(&meetings).Error; err != nil {
+		fmt.Printf("Error: 会議の取得に失敗しました: %s in listMeetings\n", userId)
+	}
+	return meetings
+}
+
+func updateMeetingName(db *gorm.DB, meetingId int, meetingName string) bool {
+	if err := db.Model(&Meeting{}).Where("meeting_id = ?", meetingId).Update("meeting_name", meetingName).Error; err != nil {
+		fmt.Printf("Error: update失敗(会議名の更新に失敗しました): %d, %s in updateMeetingName\n", meetingId, meetingName)
+		return false
+	}
+	fmt.Printf("Log: update成功(会議名を更新しました): %d, %s in updateMeetingName\n", meetingId, meetingName)
+	return true
+}
+
+// updateMeetingStartTime は開始前の会議の開始時刻を変更する
+func updateMeetingStartTime(db *gorm.DB, meetingId int, startTimeStr string) (bool, time.Time) {
+	var (
+		layout      = "2006/01/02 15:04:05"
+		location, _ = time.LoadLocation("Asia/Tokyo")
+	)
+	startTime, parse_err := time.ParseInLocation(layout, startTimeStr, location)
+	if parse_err != nil {
+		fmt.Printf("Error: 開始時刻の形式が不正です: %s in updateMeetingStartTime\n", startTimeStr)
+		return false, time.Time{}
+	}
+	if getMeetingState(db, meetingId).State != MeetingStateScheduled {
+		fmt.Printf("Error: 会議が開始済みです: %d in updateMeetingStartTime\n", meetingId)
+		return false, time.Time{}
+	}
+	result := db.Model(&Meeting{}).Where("meeting_id = ? AND meeting_done = ?", meetingId, false).Update("meeting_start_time", startTime)
+	if result.Error != nil || result.RowsAffected == 0 {
+		fmt.Printf("Error: update失敗(会議が開始済みか，開始時刻の更新に失敗しました): %d, %s in updateMeetingStartTime\n", meetingId, startTimeStr)
+		return false, time.Time{}
+	}
+	fmt.Printf("Log: update成功(開始時刻を更新しました): %d, %s in updateMeetingStartTime\n", meetingId, startTimeStr)
+	return true, startTime
+}
+
+// updatePresenters は/meeting/updateで発表者を設定し直す．
+// 開始後は発表中の発表者の発表順が崩れるため，発表順の変更は/agendaで行い，ここでは開始前の会議のみ変更できる．
+func updatePresenters(db *gorm.DB, meetingId int, presenterIds []string) bool {
+	if getMeetingState(db, meetingId).State != MeetingStateScheduled {
+		fmt.Printf("Error: 会議が開始済みです: %d in updatePresenters\n", meetingId)
+		return false
+	}
+	return setPresenters(db, meetingId, presenterIds)
+}
+
+// setPresenters は会議の発表者をpresenterIdsの順に設定し直す．
+// 外れた発表者は聴講者となり，新しい発表者には参加者と空の資料を作成する．
+func setPresenters(db *gorm.DB, meetingId int, presenterIds []string) bool {
+	tx := db.Begin()
+
+	// 一度全員の発表順を外してから並べ直す
+	if err := tx.Model(&Participant{}).Where("meeting_id = ? AND participant_order != ?", meetingId, -1).Update("participant_order", -1).Error; err != nil {
+		tx.Rollback()
+		fmt.Printf("Error: update失敗(発表順の初期化に失敗しました): %d in setPresenters\n", meetingId)
+		return false
+	}
+	if err := tx.Model(&Participant{}).Where("meeting_id = ? AND role = ?", meetingId, RolePresenter).Update("role", RoleAudience).Error; err != nil {
+		tx.Rollback()
+		fmt.Printf("Error: update失敗(発表者の役割の初期化に失敗しました): %d in setPresenters\n", meetingId)
+		return false
+	}
+
+	for i, presenterId := range presenterIds {
+		if !addPresenter(tx, meetingId, presenterId, i) {
+			tx.Rollback()
+			return false
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		fmt.Printf("Error: 発表者の更新に失敗しました: %d in setPresenters\n", meetingId)
+		return false
+	}
+	fmt.Printf("Log: update成功(発表者を更新しました): %d, %s in setPresenters\n", meetingId, presenterIds)
+	return true
+}
+
+// addPresenter はpresenterIdを発表順orderの発表者にする
+func addPresenter(db *gorm.DB, meetingId int, presenterId string, order int) bool {
+	var (
+		user        User
+		participant Participant
+		document    Document
+	)
+	if err := db.First(&user, "user_id = ?", presenterId).Error; err != nil {
+		fmt.Printf("Error: 発表者%sが見つかりません: %d in addPresenter\n", presenterId, meetingId)
+		return false
+	}
+
+	if err := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, presenterId).Error; err != nil {
+		participant = Participant{MeetingId: meetingId, UserId: presenterId, SpeakNum: 0, ParticipantOrder: order, IsJoining: false, Role: RolePresenter}
+		if err := db.Create(&participant).Error; err != nil {
+			fmt.Printf("Error: create失敗(発表者%sの登録に失敗しました): %d in addPresenter\n", presenterId, meetingId)
+			return false
+		}
+	} else {
+		updates := map[string]interface{}{"participant_order": order}
+		if participant.Role == RoleAudience || participant.Role == "" {
+			updates["role"] = RolePresenter
+		}
+		if err := db.Model(&Participant{}).Where("meeting_id = ? AND user_id = ?", meetingId, presenterId).Updates(updates).Error; err != nil {
+			fmt.Printf("Error: update失敗(発表者%sの発表順の更新に失敗しました): %d in addPresenter\n", presenterId, meetingId)
+			return false
+		}
+	}
+
+	if err := db.First(&document, "user_id = ? AND meeting_id = ?", presenterId, meetingId).Error; err != nil {
+		document = Document{UserId: presenterId, MeetingId: meetingId}
+		if err := db.Create(&document).Error; err != nil {
+			fmt.Printf("Error: create失敗(空の資料作成に失敗しました): %s, %d in addPresenter\n", presenterId, meetingId)
+			return false
+		}
+	}
+	return true
+}
+
+func cancelMeeting(db *gorm.DB, meetingId int) bool {
+	if err := db.Model(&Meeting{}).Where("meeting_id = ?", meetingId).Update("meeting_canceled", true).Error; err != nil {
+		fmt.Printf("Error: update失敗(会議の中止に失敗しました): %d in cancelMeeting\n", meetingId)
+		return false
+	}
+	fmt.Printf("Log: update成功(会議を中止しました): %d in cancelMeeting\n", meetingId)
+	return true
+}
+
+// sendMeetingUpdate は会議の最新の内容を参加者に通知する
+func (hub *Hub) sendMeetingUpdate(meetingId int) {
+	layout := "2006/01/02 15:04:05"
+	isFound, meeting := getMeeting(db, meetingId)
+	if !isFound {
+		return
+	}
+	_, presenterNames, presenterIds, documentIds := getPresenters(db, meetingId)
+	messagestruct := MeetingUpdateResult{
+		MessageType:      "meeting_update",
+		MeetingId:        meetingId,
+		MeetingName:      meeting.MeetingName,
+		MeetingStartTime: meeting.MeetingStartTime.Format(layout),
+		MeetingCanceled:  meeting.MeetingCanceled,
+		PresenterNames:   presenterNames,
+		PresenterIds:     presenterIds,
+		DocumentIds:      documentIds,
+	}
+	hub.broadcastToRoom(meetingId, messagestruct)
+	fmt.Printf("Log: 会議更新通知を送信しました: %d in sendMeetingUpdate\n", meetingId)
+}
@@ -9,59 +9,83 @@ import (
 const (
 	presenEndMessage         = "発表ありがとうございました。\n"
 	questionBodyAskMessage   = "匿名質問です。%dページについての質問です。%s\n"
+	questionBodyNamedMessage = "%sさんからの質問です。%dページについての質問です。%s\n"
 	questionModeratorMessage = "%dページについて疑問に思う方が多いようです。詳しい説明をお願いします。\n"
 	questionPersonMessage    = "次に%sさん、質問お願いします。\n"
 	questionEndMessage       = "回答ありがとうございました。\n"
-	personEndMessage         = "これで%sさんの発表時間を終わります。次の発表者は%sさんです。よろしくお願いします。\n"
-	meetingStartMessage      = "これから会議を開始します。最初の発表者は%sさんです。よろしくお願いします。\n"
+	personEndMessage         = "これで%sさんの発表時間を終わります。"
+	nextPresenterMessage     = "次の発表者は%sさんです。よろしくお願いします。\n"
+	presenterSkipMessage     = "%sさんは不在のため発表を飛ばします。"
+	presenterDeferMessage    = "%sさんは不在のため発表を最後に回します。"
+	meetingStartMessage      = "これから会議を開始します。"
+	firstPresenterMessage    = "最初の発表者は%sさんです。よろしくお願いします。\n"
 	meetingEndMessage        = "これで会議を終了します。お疲れ様でした。\n"
+	oneMinuteLeftMessage     = "残り時間はあと1分です。\n"
+	timeUpMessage            = "時間になりました。"
 )
 
-func presenOrQuestionEnd(db *gorm.DB, meetingId int, presenterId string, isPresenEnd bool, questionUserId string) (msg, qUserId string, qId int) {
+// presenOrQuestionEnd は発表もしくは質問を終え，applyQuestionPickで反映した次の質問を促す司会メッセージを返す
+func presenOrQuestionEnd(db *gorm.DB, meetingId int, isPresenEnd bool, pickQuestioner bool, suggestQuestion bool, qUserId string, qId int) (msg string) {
 	var (
-		endMessage      string
-		pickQuestioner  bool
-		suggestQuestion bool
-		dPage           int
+		endMessage string
+		dPage      int
 	)
 	if isPresenEnd {
 		endMessage = presenEndMessage
 	} else {
 		endMessage = questionEndMessage
 	}
-	pickQuestioner, suggestQuestion, qUserId, qId = selectQuestion(db, meetingId, getDocumentId(db, presenterId, meetingId), presenterId, questionUserId)
+	if qId == -1 { // 質問も当てる参加者もいない
+		return endMessage
+	}
 
 	if pickQuestioner { // 質問者を当てる
 		qUserName := getUserName(db, qUserId)
 		msg = fmt.Sprintf(endMessage+questionPersonMessage, qUserName)
-		return msg, qUserId, qId
+		return msg
 	} else { // 来ている質問を使う
 		if !suggestQuestion {
 			var qBody string
 			qBody, dPage = getQuestionBody(db, qId)
-			msg = fmt.Sprintf(endMessage+questionBodyAskMessage, dPage, qBody)
-			return msg, "", qId
+			if getMeetingSetting(db, meetingId).AnonymousQuestionAllowed {
+				msg = fmt.Sprintf(endMessage+questionBodyAskMessage, dPage, qBody)
+			} else {
+				msg = fmt.Sprintf(endMessage+questionBodyNamedMessage, getUserName(db, getQuestionUserId(db, qId)), dPage, qBody)
+			}
+			return msg
 		} else {
 			dPage = getQuestionDocumentPage(db, qId)
 			msg = fmt.Sprintf(endMessage+questionModeratorMessage, dPage)
-			return msg, "", qId
+			return msg
 		}
 	}
 }
 
-func personEnd(presenUserId string, nextUserId string, meetingId int) string {
+func personEnd(presenUserId string, nextUserId string, meetingId int, skippedIds []string, deferredIds []string) string {
 	presenUserName := getUserName(db, presenUserId)
 	nextUserName := getUserName(db, nextUserId)
 
-	return fmt.Sprintf(personEndMessage, presenUserName, nextUserName)
+	return fmt.Sprintf(personEndMessage, presenUserName) + absentPresenters(skippedIds, deferredIds) + fmt.Sprintf(nextPresenterMessage, nextUserName)
+}
+
+// absentPresenters は飛ばした発表者と最後に回した発表者について説明する
+func absentPresenters(skippedIds []string, deferredIds []string) string {
+	msg := ""
+	for _, userId := range deferredIds {
+		msg += fmt.Sprintf(presenterDeferMessage, getUserName(db, userId))
+	}
+	for _, userId := range skippedIds {
+		msg += fmt.Sprintf(presenterSkipMessage, getUserName(db, userId))
+	}
+	return msg
 }
 
-func meetingStart(meetingId int) string {
-	FirstPresenUserName := getFirstPresenUserName(db, meetingId)
+func meetingStart(firstUserId string, skippedIds []string, deferredIds []string) string {
+	FirstPresenUserName := getUserName(db, firstUserId)
 
-	return fmt.Sprintf(meetingStartMessage, FirstPresenUserName)
+	return meetingStartMessage + absentPresenters(skippedIds, deferredIds) + fmt.Sprintf(firstPresenterMessage, FirstPresenUserName)
 }
 
-func meetingEnd() string {
-	return meetingEndMessage
+func meetingEnd(skippedIds []string, deferredIds []string) string {
+	return absentPresenters(skippedIds, deferredIds) + meetingEndMessage
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyPasswordHash は存在しないユーザーのログイン時にも同じ時間をかけて照合するためのハッシュ
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// hashPassword はパスワードをbcryptでハッシュ化する(ソルトはハッシュごとに生成される)
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// isPasswordHash は保存されている値がbcryptのハッシュかどうかを返す．
+// ハッシュでなければハッシュ化導入前に平文で保存されたパスワードである．
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// verifyPassword は保存されている値とpasswordを照合する．
+// 平文で保存されている場合は一致してもneedsRehashがtrueとなり，呼び出し元でハッシュ化して保存し直す．
+func verifyPassword(stored string, password string) (isValid bool, needsRehash bool) {
+	if !isPasswordHash(stored) {
+		isValid = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return isValid, isValid
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	cost, _ := bcrypt.Cost([]byte(stored))
+	return true, cost < bcrypt.DefaultCost
+}
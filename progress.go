@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// 残り時間を通知する間隔
+	countdownTickInterval = 10 * time.Second
+
+	// 残り時間がこれを切ったら司会が警告する
+	countdownWarning = 1 * time.Minute
+)
+
+// CountdownMsg は発表もしくは質疑応答の残り時間を通知するメッセージ
+type CountdownMsg struct {
+	MessageType  string `json:"messageType"`
+	MeetingId    int    `json:"meetingId"`
+	Phase        string `json:"phase"`
+	PresenterId  string `json:"presenterId"`
+	RemainingSec int    `json:"remainingSec"`
+}
+
+// Progress は会議の進行(MeetingStateの遷移)と，発表と質疑応答の制限時間を管理する
+// ロックと制限時間はプロセスごとに持つが，複数のプロセスで動かす場合も状態の遷移はMeetingStateのVersionで排他される．
+type Progress struct {
+	mu     sync.Mutex
+	clock  Clock
+	hub    *Hub
+	locks  map[int]*sync.Mutex  // 会議ごとに進行の処理を直列にする
+	timers map[int]*phaseTimer  // 制限時間のある会議の現在のフェーズ
+	paused map[int]*pausedPhase // 休憩で止めた制限時間
+}
+
+// phaseTimer は発表1件もしくは発表者1人分の質疑応答の制限時間
+type phaseTimer struct {
+	phase       string // MeetingStatePresentingかMeetingStateQuestion
+	presenterId string
+	endTime     time.Time
+	isWarned    bool
+	timer       Timer
+}
+
+// pausedPhase は休憩で止めた制限時間．再開時に残り時間から再び数える
+type pausedPhase struct {
+	phase       string
+	presenterId string
+	remaining   time.Duration
+	isWarned    bool
+}
+
+func newProgress(clock Clock, hub *Hub) *Progress {
+	return &Progress{
+		clock:  clock,
+		hub:    hub,
+		locks:  make(map[int]*sync.Mutex),
+		timers: make(map[int]*phaseTimer),
+		paused: make(map[int]*pausedPhase),
+	}
+}
+
+func (p *Progress) meetingLock(meetingId int) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lock, ok := p.locks[meetingId]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.locks[meetingId] = lock
+	}
+	return lock
+}
+
+// start は開始済みの会議を最初の発表者の発表に進め，開始の司会メッセージを返す．
+// 不在の発表者は次の発表者へ進む時と同様に飛ばすか最後に回す．
+func (p *Progress) start(meetingId int) (bool, ModeratorMsg) {
+	lock := p.meetingLock(meetingId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	endPresen, presenterId, presentOrder, skippedIds, deferredIds := getFirstPresenterId(db, meetingId)
+	if endPresen {
+		// 開始時刻に発表者が誰も揃っていない場合は，会議を終えずに発表順の最初の発表者を待つ
+		presenterId, presentOrder, skippedIds, deferredIds = getPresenterIdByOrder(db, meetingId, 0), 0, []string{}, []string{}
+	}
+	if presenterId == "" {
+		return false, ModeratorMsg{}
+	}
+	ok, state := transitMeetingState(db, meetingId, MeetingState{
+		State:        MeetingStatePresenting,
+		PresentOrder: presentOrder,
+		PresenterId:  presenterId,
+	})
+	if !ok {
+		return false, ModeratorMsg{}
+	}
+	deferPresenters(db, meetingId, deferredIds)
+	p.enter(state)
+	return true, ModeratorMsg{
+		MessageType:      ModeratorMsgType,
+		MeetingId:        meetingId,
+		ModeratorMsgBody: meetingStart(presenterId, skippedIds, deferredIds),
+		IsStartPresen:    true,
+		QuestionId:       -1,
+		QuestionUserId:   "",
+		PresentOrder:     presentOrder,
+	}
+}
+
+// stop は会議の中止時に制限時間を止める
+func (p *Progress) stop(meetingId int) {
+	lock := p.meetingLock(meetingId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopTimer(meetingId)
+	delete(p.paused, meetingId)
+}
+
+// finish はfinishwordを受けて発表もしくは質問を終え，次の司会メッセージを返す．
+// 会議の状態がfinishTypeと発表者に一致しない場合(二重送信など)はfalseを返す．
+func (p *Progress) finish(meetingId int, presenterId string, finishType string) (bool, ModeratorMsg) {
+	lock := p.meetingLock(meetingId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current := getMeetingState(db, meetingId)
+	isExpected := (finishType == "present" && current.State == MeetingStatePresenting) || (finishType == "question" && current.State == MeetingStateQuestion)
+	if !isExpected || current.PresenterId != presenterId {
+		fmt.Printf("Error: 会議の状態と一致しないfinishwordです: %d, %s, %s (状態: %s, %s) in finish\n", meetingId, presenterId, finishType, current.State, current.PresenterId)
+		return false, ModeratorMsg{}
+	}
+	return p.advance(current, false)
+}
+
+// setBreak は会議を休憩にする，もしくは休憩から再開する．
+// 再開時は休憩前の発表もしくは質疑応答に戻り，制限時間は休憩前の残り時間から数える．
+func (p *Progress) setBreak(meetingId int, isBreak bool) (bool, MeetingState) {
+	lock := p.meetingLock(meetingId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	next := getMeetingState(db, meetingId)
+	if isBreak {
+		next.State = MeetingStateBreak
+	} else {
+		if next.State != MeetingStateBreak {
+			fmt.Printf("Error: 休憩中ではありません: %d in setBreak\n", meetingId)
+			return false, next
+		}
+		next.State = MeetingStatePresenting
+		if next.QuestionNum > 0 {
+			next.State = MeetingStateQuestion
+		}
+	}
+	ok, state := transitMeetingState(db, meetingId, next)
+	if ok {
+		p.enter(state)
+	}
+	return ok, state
+}
+
+// advance はcurrentの状態から次に進み，司会メッセージを返す．
+// forceNextの場合は質問数に関わらず次の発表者へ進む．
+// 呼び出し元で会議のロックを取得していること．
+func (p *Progress) advance(current MeetingState, forceNext bool) (bool, ModeratorMsg) {
+	next, plan := advanceMeeting(current, forceNext)
+	ok, state := transitMeetingState(db, current.MeetingId, next)
+	if !ok {
+		return false, ModeratorMsg{}
+	}
+	// 質問を回答済みにするなどの変更は，状態を遷移できた場合のみ反映する
+	message := applyAdvance(current, plan)
+	p.enter(state)
+	// 挙手から当てた場合は待ち行列が進むため通知する
+	if message.QuestionUserId != "" {
+		p.hub.sendHandQueue(current.MeetingId, getDocumentId(db, current.PresenterId, current.MeetingId))
+	}
+	// 投稿された質問を読み上げた場合は回答済みになったことを通知する
+	if message.QuestionId > 0 {
+		if ok, question := getQuestion(db, message.QuestionId); ok && !question.IsVoice && question.UserId != "Moderator" {
+			p.hub.broadcastToRoom(current.MeetingId, newQuestionStatusResult(current.MeetingId, question))
+			// 同じまとまりの質問もまとめて回答済みになる
+			if question.ClusterId != 0 {
+				for _, q := range getClusterQuestions(db, question.ClusterId) {
+					if q.QuestionId != question.QuestionId && questionStatus(q) == QuestionStatusAnswered {
+						p.hub.broadcastToRoom(current.MeetingId, newQuestionStatusResult(current.MeetingId, q))
+					}
+				}
+			}
+		}
+	}
+	return true, message
+}
+
+// enter は新しい状態を参加者に通知し，設定に応じて制限時間を開始する．
+// 同じ発表者の質疑応答が続く場合は制限時間を引き継ぎ，休憩から再開した場合は休憩前の残り時間から数える．
+// 呼び出し元で会議のロックを取得していること．
+func (p *Progress) enter(state MeetingState) {
+	p.hub.sendMeetingState(state)
+
+	meetingId := state.MeetingId
+	p.mu.Lock()
+	if t, ok := p.timers[meetingId]; ok && state.State == MeetingStateQuestion && t.phase == MeetingStateQuestion && t.presenterId == state.PresenterId {
+		p.mu.Unlock()
+		return
+	}
+	paused, isPaused := p.paused[meetingId]
+	delete(p.paused, meetingId)
+	pausedSec := 0
+	if t, ok := p.timers[meetingId]; ok && state.State == MeetingStateBreak {
+		p.paused[meetingId] = &pausedPhase{
+			phase:       t.phase,
+			presenterId: t.presenterId,
+			remaining:   t.endTime.Sub(p.clock.Now()),
+			isWarned:    t.isWarned,
+		}
+		pausedSec = int((p.paused[meetingId].remaining + time.Second - 1) / time.Second)
+	}
+	p.stopTimer(meetingId)
+	if state.State != MeetingStatePresenting && state.State != MeetingStateQuestion {
+		p.mu.Unlock()
+		saveMeetingPhase(db, meetingId, nil, pausedSec)
+		return
+	}
+
+	var (
+		duration time.Duration
+		isWarned bool
+	)
+	if isPaused && paused.phase == state.State && paused.presenterId == state.PresenterId {
+		duration = paused.remaining
+		isWarned = paused.isWarned
+		if duration < time.Second {
+			// 時間切れの直前に休憩した場合も，再開後に時間切れとして進める
+			duration = time.Second
+		}
+	} else {
+		setting := getMeetingSetting(db, meetingId)
+		duration = time.Duration(setting.PresentDurationSec) * time.Second
+		if state.State == MeetingStateQuestion {
+			duration = time.Duration(setting.QuestionDurationSec) * time.Second
+		}
+		isWarned = duration <= countdownWarning
+	}
+	if duration <= 0 {
+		p.mu.Unlock()
+		saveMeetingPhase(db, meetingId, nil, 0)
+		return
+	}
+
+	now := p.clock.Now()
+	t := &phaseTimer{
+		phase:       state.State,
+		presenterId: state.PresenterId,
+		endTime:     now.Add(duration),
+		isWarned:    isWarned,
+	}
+	p.timers[meetingId] = t
+	p.arm(meetingId, t, now)
+	p.mu.Unlock()
+
+	saveMeetingPhase(db, meetingId, &t.endTime, 0)
+	// 通知はHubのゴルーチンに渡るまで待つため，p.muを解放してから送る
+	p.sendCountdown(meetingId, t, duration)
+	fmt.Printf("Log: 制限時間を開始しました: %d, %s, %s, %s in enter\n", meetingId, state.State, state.PresenterId, duration)
+}
+
+// loadPhases は進行中の会議の制限時間をDBから読み込み直す．再起動時に呼び出す
+func (p *Progress) loadPhases(db *gorm.DB) {
+	p.restorePhases(getProgressingMeetingStates(db))
+}
+
+// restorePhases は保存された制限時間から，発表中と質疑応答中の会議のタイマーと，休憩中の会議の残り時間を戻す．
+// 停止中に制限時間を過ぎた会議はすぐに時間切れとして次に進む
+func (p *Progress) restorePhases(states []MeetingState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	for _, state := range states {
+		switch {
+		case (state.State == MeetingStatePresenting || state.State == MeetingStateQuestion) && state.PhaseEndTime != nil:
+			t := &phaseTimer{
+				phase:       state.State,
+				presenterId: state.PresenterId,
+				endTime:     *state.PhaseEndTime,
+				isWarned:    state.PhaseEndTime.Sub(now) <= countdownWarning,
+			}
+			p.stopTimer(state.MeetingId)
+			p.timers[state.MeetingId] = t
+			p.arm(state.MeetingId, t, now)
+			fmt.Printf("Log: 制限時間を戻しました: %d, %s, %s in restorePhases\n", state.MeetingId, state.State, state.PhaseEndTime)
+		case state.State == MeetingStateBreak && state.PausedSec > 0:
+			// setBreakと同様に，質問数から休憩前のフェーズを判断する
+			phase := MeetingStatePresenting
+			if state.QuestionNum > 0 {
+				phase = MeetingStateQuestion
+			}
+			remaining := time.Duration(state.PausedSec) * time.Second
+			p.paused[state.MeetingId] = &pausedPhase{
+				phase:       phase,
+				presenterId: state.PresenterId,
+				remaining:   remaining,
+				isWarned:    remaining <= countdownWarning,
+			}
+			fmt.Printf("Log: 休憩前の残り時間を戻しました: %d, %s in restorePhases\n", state.MeetingId, remaining)
+		}
+	}
+}
+
+// remainingSec は現在のフェーズの残り時間(秒)を返す．制限時間がない場合は-1
+func (p *Progress) remainingSec(meetingId int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.timers[meetingId]
+	if !ok {
+		return -1
+	}
+	remaining := t.endTime.Sub(p.clock.Now())
+	if remaining < 0 {
+		return 0
+	}
+	return int((remaining + time.Second - 1) / time.Second)
+}
+
+// stopTimer は会議の制限時間を止める．呼び出し元でp.muを取得していること．
+func (p *Progress) stopTimer(meetingId int) {
+	if t, ok := p.timers[meetingId]; ok {
+		t.timer.Stop()
+		delete(p.timers, meetingId)
+	}
+}
+
+// arm は次の残り時間の通知，警告，時間切れのうち最も早い時刻にタイマーを設定する．呼び出し元でp.muを取得していること．
+func (p *Progress) arm(meetingId int, t *phaseTimer, now time.Time) {
+	next := now.Add(countdownTickInterval)
+	if warnTime := t.endTime.Add(-countdownWarning); !t.isWarned && warnTime.Before(next) {
+		next = warnTime
+	}
+	if t.endTime.Before(next) {
+		next = t.endTime
+	}
+	t.timer = p.clock.AfterFunc(next.Sub(now), func() { p.tick(meetingId, t) })
+}
+
+func (p *Progress) tick(meetingId int, t *phaseTimer) {
+	lock := p.meetingLock(meetingId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.mu.Lock()
+	// 手動で次に進んだ後に発火した古いタイマーは無視する
+	if p.timers[meetingId] != t {
+		p.mu.Unlock()
+		return
+	}
+	now := p.clock.Now()
+	remaining := t.endTime.Sub(now)
+	p.mu.Unlock()
+
+	if remaining <= 0 {
+		p.timeUp(meetingId, t)
+		return
+	}
+	if !t.isWarned && remaining <= countdownWarning {
+		t.isWarned = true
+		p.hub.broadcastToRoom(meetingId, ModeratorMsg{
+			MessageType:      ModeratorMsgType,
+			MeetingId:        meetingId,
+			ModeratorMsgBody: oneMinuteLeftMessage,
+			IsStartPresen:    false,
+			QuestionId:       -1,
+			QuestionUserId:   "",
+			PresentOrder:     -1,
+		})
+	}
+
+	p.mu.Lock()
+	p.arm(meetingId, t, now)
+	p.mu.Unlock()
+	p.sendCountdown(meetingId, t, remaining)
+}
+
+// timeUp は制限時間を過ぎたフェーズを終えて次に進む．
+// 発表の時間切れでは質疑応答へ，質疑応答の時間切れでは質問数に関わらず次の発表者へ進む．
+func (p *Progress) timeUp(meetingId int, t *phaseTimer) {
+	fmt.Printf("Log: 制限時間を過ぎました: %d, %s, %s in timeUp\n", meetingId, t.phase, t.presenterId)
+	current := getMeetingState(db, meetingId)
+	if current.State != t.phase || current.PresenterId != t.presenterId {
+		p.mu.Lock()
+		p.stopTimer(meetingId)
+		p.mu.Unlock()
+		return
+	}
+	ok, message := p.advance(current, current.State == MeetingStateQuestion)
+	if !ok {
+		return
+	}
+	message.ModeratorMsgBody = timeUpMessage + message.ModeratorMsgBody
+	p.hub.broadcastToRoom(meetingId, message)
+}
+
+// sendCountdown は残り時間を通知する．Hubへの送信を待つため，p.muを取得したまま呼び出さないこと．
+func (p *Progress) sendCountdown(meetingId int, t *phaseTimer, remaining time.Duration) {
+	p.hub.broadcastEphemeral(meetingId, CountdownMsg{
+		MessageType:  "countdown",
+		MeetingId:    meetingId,
+		Phase:        t.phase,
+		PresenterId:  t.presenterId,
+		RemainingSec: int((remaining + time.Second - 1) / time.Second),
+	})
+}
+
+// advancePlan は次の状態へ遷移した後にapplyAdvanceで反映する変更
+type advancePlan struct {
+	isPresenEnd bool
+	documentId  int
+	pick        QuestionPick // PickNone以外なら質疑応答を続ける
+	endPresen   bool
+	nextUserId  string
+	nextOrder   int
+	skippedIds  []string
+	deferredIds []string
+}
+
+// advanceMeeting は発表中もしくは質疑応答中のcurrentから次の質問者か発表者を決め，次の状態と遷移後に反映する変更を返す．
+// 遷移に失敗した場合に備え，ここではDBを変更しない．
+// forceNextの場合は質問数に関わらず次の発表者へ進む．
+func advanceMeeting(current MeetingState, forceNext bool) (MeetingState, advancePlan) {
+	var (
+		meetingId   = current.MeetingId
+		presenterId = current.PresenterId
+		plan        = advancePlan{isPresenEnd: current.State == MeetingStatePresenting, pick: QuestionPick{Kind: PickNone}, nextOrder: -1}
+	)
+	// 規定の質問数に達していなければ次の質問へ進む
+	setting := getMeetingSetting(db, meetingId)
+	if !forceNext && current.QuestionNum < setting.MaxQuestionNum {
+		plan.documentId = getDocumentId(db, presenterId, meetingId)
+		plan.pick = pickQuestion(gormQuestionStore{db: db}, meetingId, plan.documentId, presenterId, current.QuestionUserId)
+		// 質問も当てる参加者もいない場合は次の発表者へ進む
+		if plan.pick.Kind != PickNone {
+			next := MeetingState{
+				State:          MeetingStateQuestion,
+				PresentOrder:   current.PresentOrder,
+				PresenterId:    presenterId,
+				QuestionNum:    current.QuestionNum + 1,
+				QuestionUserId: pickUserId(plan.pick),
+			}
+			fmt.Printf("Log: 現在の質問数：%d in advanceMeeting\n", next.QuestionNum)
+			return next, plan
+		}
+	}
+
+	plan.endPresen, plan.nextUserId, plan.nextOrder, plan.skippedIds, plan.deferredIds = getNextPresenterId(db, meetingId, presenterId)
+	if plan.endPresen {
+		return MeetingState{
+			State:        MeetingStateEnded,
+			PresentOrder: -1,
+		}, plan
+	}
+	return MeetingState{
+		State:        MeetingStatePresenting,
+		PresentOrder: plan.nextOrder,
+		PresenterId:  plan.nextUserId,
+	}, plan
+}
+
+// applyAdvance はadvanceMeetingで決めた変更(質問を回答済みにする，不在の発表者を最後に回すなど)を反映し，司会メッセージを返す
+func applyAdvance(current MeetingState, plan advancePlan) ModeratorMsg {
+	meetingId := current.MeetingId
+	message := ModeratorMsg{
+		MessageType:      ModeratorMsgType,
+		MeetingId:        meetingId,
+		ModeratorMsgBody: "",
+		IsStartPresen:    false,
+		QuestionId:       -1,
+		QuestionUserId:   "",
+		PresentOrder:     -1,
+	}
+	if plan.pick.Kind != PickNone {
+		pickQuestioner, suggestQuestion, questionUserId, questionId := applyQuestionPick(gormQuestionStore{db: db}, meetingId, plan.documentId, plan.pick)
+		message.ModeratorMsgBody = presenOrQuestionEnd(db, meetingId, plan.isPresenEnd, pickQuestioner, suggestQuestion, questionUserId, questionId)
+		message.QuestionId = questionId
+		message.QuestionUserId = questionUserId
+		return message
+	}
+
+	deferPresenters(db, meetingId, plan.deferredIds)
+	if plan.endPresen {
+		message.ModeratorMsgBody = meetingEnd(plan.skippedIds, plan.deferredIds)
+		return message
+	}
+	message.ModeratorMsgBody = personEnd(current.PresenterId, plan.nextUserId, meetingId, plan.skippedIds, plan.deferredIds)
+	message.IsStartPresen = true
+	message.PresentOrder = plan.nextOrder
+	return message
+}
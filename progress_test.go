@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressRestorePhases(t *testing.T) {
+	now := time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+	endTime := now.Add(5 * time.Minute)
+	expired := now.Add(-1 * time.Minute)
+	tests := []struct {
+		name          string
+		state         MeetingState
+		wantRemaining int    // 制限時間の残り(秒)．制限時間がない場合は-1
+		wantPhase     string // 休憩前のフェーズ．休憩中でない場合は空
+		wantPaused    time.Duration
+	}{
+		{"発表中の残り時間を戻す",
+			MeetingState{MeetingId: 1, State: MeetingStatePresenting, PresenterId: "a", PhaseEndTime: &endTime}, 300, "", 0},
+		{"停止中に時間切れになった質疑応答",
+			MeetingState{MeetingId: 1, State: MeetingStateQuestion, PresenterId: "a", QuestionNum: 1, PhaseEndTime: &expired}, 0, "", 0},
+		{"制限時間のない発表",
+			MeetingState{MeetingId: 1, State: MeetingStatePresenting, PresenterId: "a"}, -1, "", 0},
+		{"休憩前の発表の残り時間を戻す",
+			MeetingState{MeetingId: 1, State: MeetingStateBreak, PresenterId: "a", PausedSec: 90}, -1, MeetingStatePresenting, 90 * time.Second},
+		{"休憩前の質疑応答の残り時間を戻す",
+			MeetingState{MeetingId: 1, State: MeetingStateBreak, PresenterId: "a", QuestionNum: 2, PausedSec: 30}, -1, MeetingStateQuestion, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progress := newProgress(newFakeClock(now), nil)
+
+			progress.restorePhases([]MeetingState{tt.state})
+
+			if got := progress.remainingSec(1); got != tt.wantRemaining {
+				t.Errorf("残り時間 = %d, want %d", got, tt.wantRemaining)
+			}
+			paused, ok := progress.paused[1]
+			if tt.wantPhase == "" {
+				if ok {
+					t.Errorf("休憩中でないのに残り時間が戻されました: %+v", paused)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("休憩前の残り時間が戻されていません")
+			}
+			if paused.phase != tt.wantPhase || paused.presenterId != "a" || paused.remaining != tt.wantPaused {
+				t.Errorf("休憩前の残り時間 = %+v, want %s, a, %s", paused, tt.wantPhase, tt.wantPaused)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Web Socketのメッセージの形式のバージョン．versionを省略したメッセージはこのバージョンとして扱う
+const protocolVersion = 1
+
+// 質問本文の最大の文字数
+const maxQuestionBodyLength = 1000
+
+// エラーメッセージのコード
+const (
+	ErrorCodeInvalidJson        = "invalid_json"         // JSONとして読めない
+	ErrorCodeUnsupportedVersion = "unsupported_version"  // 対応していないversion
+	ErrorCodeUnknownMessageType = "unknown_message_type" // 未知のmessageType
+	ErrorCodeInvalidField       = "invalid_field"        // 項目の欠落や型，値の誤り
+	ErrorCodeForbidden          = "forbidden"            // 権限がない，もしくは他人や他の会議を対象にしている
+	ErrorCodeInvalidState       = "invalid_state"        // 会議の進行状態と合わない
+	ErrorCodeFailed             = "failed"               // 処理に失敗した
+)
+
+// Envelope は全てのメッセージに共通する項目．
+// requestIdを付けたメッセージには，処理の結果としてackかerrorが送信者にのみ返る．
+type Envelope struct {
+	Version     int    `json:"version"`
+	MessageType string `json:"messageType"`
+	RequestId   string `json:"requestId"`
+}
+
+// AckResult は受け取ったメッセージを処理できたことを送信者にのみ伝えるメッセージ．
+// Dataは同じ会議に送信したメッセージで，ackはそのメッセージの後にその通し番号を付けて届く．
+// 宛先を限定したメッセージには通し番号がないため，ackとの順序は保証しない
+type AckResult struct {
+	MessageType        string      `json:"messageType"`
+	RequestId          string      `json:"requestId"`
+	RequestMessageType string      `json:"requestMessageType"`
+	Data               interface{} `json:"data"`
+}
+
+// ErrorResult は受け取ったメッセージを処理できなかったことを送信者にのみ伝えるメッセージ
+type ErrorResult struct {
+	MessageType        string `json:"messageType"`
+	RequestId          string `json:"requestId"`
+	Code               string `json:"code"`
+	Message            string `json:"message"`
+	RequestMessageType string `json:"requestMessageType"`
+}
+
+// ProtocolError はメッセージの処理に失敗した理由
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func newProtocolError(code string, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// httpStatus はRESTで返すステータスコード．処理の失敗はRESTの他のAPIと同様に200でresultをfalseにする
+func (perr *ProtocolError) httpStatus() int {
+	switch perr.Code {
+	case ErrorCodeInvalidJson, ErrorCodeUnsupportedVersion, ErrorCodeUnknownMessageType, ErrorCodeInvalidField:
+		return http.StatusBadRequest
+	case ErrorCodeForbidden:
+		return http.StatusForbidden
+	case ErrorCodeInvalidState:
+		return http.StatusConflict
+	default:
+		return http.StatusOK
+	}
+}
+
+// clientMessage はvalidateで項目を検証できるメッセージ
+type clientMessage interface {
+	validate() *ProtocolError
+}
+
+// decodeMessage はdataをmessageに読み込み，項目を検証する
+func decodeMessage(data []byte, message clientMessage) *ProtocolError {
+	if err := json.Unmarshal(data, message); err != nil {
+		return newProtocolError(ErrorCodeInvalidField, "項目の型が不正です: %s", err)
+	}
+	return message.validate()
+}
+
+func requiredField(name string) *ProtocolError {
+	return newProtocolError(ErrorCodeInvalidField, "%sは必須です", name)
+}
+
+type MessageMessage struct {
+	Message string `json:"message"`
+}
+
+func (m *MessageMessage) validate() *ProtocolError {
+	if m.Message == "" {
+		return requiredField("message")
+	}
+	return nil
+}
+
+type QuestionMessage struct {
+	UserId       string `json:"userId"`
+	MeetingId    int    `json:"meetingId"`
+	QuestionBody string `json:"questionBody"`
+	DocumentId   int    `json:"documentId"`
+	DocumentPage int    `json:"documentPage"`
+	QuestionTime string `json:"questionTime"`
+}
+
+func (m *QuestionMessage) validate() *ProtocolError {
+	switch {
+	case m.UserId == "":
+		return requiredField("userId")
+	case m.MeetingId <= 0:
+		return requiredField("meetingId")
+	case m.QuestionBody == "":
+		return requiredField("questionBody")
+	case utf8.RuneCountInString(m.QuestionBody) > maxQuestionBodyLength:
+		return newProtocolError(ErrorCodeInvalidField, "questionBodyは%d文字以内にしてください", maxQuestionBodyLength)
+	case m.DocumentId <= 0:
+		return requiredField("documentId")
+	case m.DocumentPage < 0:
+		return newProtocolError(ErrorCodeInvalidField, "documentPageが不正です: %d", m.DocumentPage)
+	}
+	if _, err := time.Parse("2006/01/02 15:04:05", m.QuestionTime); err != nil {
+		return newProtocolError(ErrorCodeInvalidField, "questionTimeの形式が不正です: %s", m.QuestionTime)
+	}
+	return nil
+}
+
+type QuestionVoteMessage struct {
+	QuestionId int   `json:"questionId"`
+	IsVote     *bool `json:"isVote"`
+}
+
+func (m *QuestionVoteMessage) validate() *ProtocolError {
+	switch {
+	case m.QuestionId <= 0:
+		return requiredField("questionId")
+	case m.IsVote == nil:
+		return requiredField("isVote")
+	}
+	return nil
+}
+
+type HandsUpMessage struct {
+	UserId       string `json:"userId"`
+	DocumentId   int    `json:"documentId"`
+	DocumentPage int    `json:"documentPage"`
+	IsUp         *bool  `json:"isUp"`
+}
+
+func (m *HandsUpMessage) validate() *ProtocolError {
+	switch {
+	case m.UserId == "":
+		return requiredField("userId")
+	case m.DocumentId <= 0:
+		return requiredField("documentId")
+	case m.DocumentPage < 0:
+		return newProtocolError(ErrorCodeInvalidField, "documentPageが不正です: %d", m.DocumentPage)
+	case m.IsUp == nil:
+		return requiredField("isUp")
+	}
+	return nil
+}
+
+type ReactionMessage struct {
+	DocumentId   int   `json:"documentId"`
+	DocumentPage int   `json:"documentPage"`
+	IsReaction   *bool `json:"isReaction"`
+}
+
+func (m *ReactionMessage) validate() *ProtocolError {
+	switch {
+	case m.DocumentId <= 0:
+		return requiredField("documentId")
+	case m.DocumentPage < 0:
+		return newProtocolError(ErrorCodeInvalidField, "documentPageが不正です: %d", m.DocumentPage)
+	case m.IsReaction == nil:
+		return requiredField("isReaction")
+	}
+	return nil
+}
+
+type AgendaReorderMessage struct {
+	PresenterIds []string `json:"presenterIds"`
+}
+
+func (m *AgendaReorderMessage) validate() *ProtocolError {
+	if len(m.PresenterIds) == 0 {
+		return requiredField("presenterIds")
+	}
+	return nil
+}
+
+type AgendaInsertMessage struct {
+	PresenterId string `json:"presenterId"`
+	Position    int    `json:"position"`
+}
+
+func (m *AgendaInsertMessage) validate() *ProtocolError {
+	switch {
+	case m.PresenterId == "":
+		return requiredField("presenterId")
+	case m.Position < 0:
+		return newProtocolError(ErrorCodeInvalidField, "positionが不正です: %d", m.Position)
+	}
+	return nil
+}
+
+type AgendaPostponeMessage struct {
+	PresenterId string `json:"presenterId"`
+}
+
+func (m *AgendaPostponeMessage) validate() *ProtocolError {
+	if m.PresenterId == "" {
+		return requiredField("presenterId")
+	}
+	return nil
+}
+
+type FinishWordMessage struct {
+	MeetingId   int    `json:"meetingId"`
+	PresenterId string `json:"presenterId"`
+	FinishType  string `json:"finishType"`
+}
+
+func (m *FinishWordMessage) validate() *ProtocolError {
+	switch {
+	case m.MeetingId <= 0:
+		return requiredField("meetingId")
+	case m.PresenterId == "":
+		return requiredField("presenterId")
+	case m.FinishType != "present" && m.FinishType != "question":
+		return newProtocolError(ErrorCodeInvalidField, "finishTypeが不正です: %s", m.FinishType)
+	}
+	return nil
+}
+
+type HandsReorderMessage struct {
+	DocumentId int      `json:"documentId"`
+	UserIds    []string `json:"userIds"`
+}
+
+func (m *HandsReorderMessage) validate() *ProtocolError {
+	switch {
+	case m.DocumentId <= 0:
+		return requiredField("documentId")
+	case len(m.UserIds) == 0:
+		return requiredField("userIds")
+	}
+	return nil
+}
+
+type HandsClearMessage struct {
+	DocumentId int `json:"documentId"`
+}
+
+func (m *HandsClearMessage) validate() *ProtocolError {
+	if m.DocumentId <= 0 {
+		return requiredField("documentId")
+	}
+	return nil
+}
+
+type QuestionEditMessage struct {
+	QuestionId   int    `json:"questionId"`
+	QuestionBody string `json:"questionBody"`
+}
+
+func (m *QuestionEditMessage) validate() *ProtocolError {
+	switch {
+	case m.QuestionId <= 0:
+		return requiredField("questionId")
+	case m.QuestionBody == "":
+		return requiredField("questionBody")
+	case utf8.RuneCountInString(m.QuestionBody) > maxQuestionBodyLength:
+		return newProtocolError(ErrorCodeInvalidField, "questionBodyは%d文字以内にしてください", maxQuestionBodyLength)
+	}
+	return nil
+}
+
+// QuestionCloseMessage はquestion_withdraw，question_dismiss，question_answeredで共通のメッセージ
+type QuestionCloseMessage struct {
+	QuestionId int `json:"questionId"`
+}
+
+func (m *QuestionCloseMessage) validate() *ProtocolError {
+	if m.QuestionId <= 0 {
+		return requiredField("questionId")
+	}
+	return nil
+}
+
+type QuestionMergeMessage struct {
+	QuestionId       int `json:"questionId"`
+	TargetQuestionId int `json:"targetQuestionId"`
+}
+
+func (m *QuestionMergeMessage) validate() *ProtocolError {
+	switch {
+	case m.QuestionId <= 0:
+		return requiredField("questionId")
+	case m.TargetQuestionId <= 0:
+		return requiredField("targetQuestionId")
+	case m.QuestionId == m.TargetQuestionId:
+		return newProtocolError(ErrorCodeInvalidField, "同じ質問には統合できません: %d", m.QuestionId)
+	}
+	return nil
+}
+
+// QuestionReviewMessage はquestion_approve，question_rejectで共通のメッセージ
+type QuestionReviewMessage struct {
+	QuestionId int `json:"questionId"`
+}
+
+func (m *QuestionReviewMessage) validate() *ProtocolError {
+	if m.QuestionId <= 0 {
+		return requiredField("questionId")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestQuestionBodyLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode string
+	}{
+		{"空", "", ErrorCodeInvalidField},
+		{"最大の文字数", strings.Repeat("質", maxQuestionBodyLength), ""},
+		{"最大の文字数を超える", strings.Repeat("質", maxQuestionBodyLength+1), ErrorCodeInvalidField},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			question := &QuestionMessage{UserId: "user", MeetingId: 1, QuestionBody: tt.body, DocumentId: 1, QuestionTime: "2021/08/01 10:00:00"}
+			edit := &QuestionEditMessage{QuestionId: 1, QuestionBody: tt.body}
+			for _, perr := range []*ProtocolError{question.validate(), edit.validate()} {
+				code := ""
+				if perr != nil {
+					code = perr.Code
+				}
+				if code != tt.wantCode {
+					t.Errorf("エラーのコード = %q, want %q", code, tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxQuestionFitsReadLimit(t *testing.T) {
+	// 最大の文字数の質問は接続を切られずに検証まで届く
+	message := struct {
+		Envelope
+		QuestionMessage
+	}{
+		Envelope:        Envelope{Version: protocolVersion, MessageType: "question", RequestId: strings.Repeat("r", 64)},
+		QuestionMessage: QuestionMessage{UserId: strings.Repeat("u", 64), MeetingId: 1, QuestionBody: strings.Repeat("𠮷", maxQuestionBodyLength), DocumentId: 1, QuestionTime: "2021/08/01 10:00:00"},
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > maxMessageSize {
+		t.Errorf("最大の質問の大きさ = %d, 読み込みの上限 %d を超えています", len(data), maxMessageSize)
+	}
+}
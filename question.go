@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 投稿された質問の状態．open以外の質問はQuestionOkをtrueにし，質問の候補から外す
+const (
+	QuestionStatusOpen      = "open"      // 未回答
+	QuestionStatusAnswered  = "answered"  // 回答済み(読み上げられたか，回答済みにされた)
+	QuestionStatusDismissed = "dismissed" // 発表者や司会が取り下げた
+	QuestionStatusWithdrawn = "withdrawn" // 質問者が取り下げた
+	QuestionStatusMerged    = "merged"    // 他の質問に統合された(MergedIntoが統合先)
+	QuestionStatusPending   = "pending"   // 主催者か共同司会者の承認待ち(承認されるまでQuestionOkをtrueにして候補から外す)
+)
+
+// QuestionStatusResult は質問の状態や内容の変化を参加者に通知するメッセージ
+type QuestionStatusResult struct {
+	MessageType  string `json:"messageType"`
+	MeetingId    int    `json:"meetingId"`
+	QuestionId   int    `json:"questionId"`
+	Status       string `json:"status"`
+	QuestionBody string `json:"questionBody"`
+	VoteNum      int    `json:"voteNum"`
+	MergedInto   int    `json:"mergedInto"` // 統合先の質問ID．統合されていない場合は-1
+	ClusterId    int    `json:"clusterId"`  // 似た質問のまとまりのID．まとまりに属さない場合は-1
+}
+
+// questionStatus は質問の状態を返す．状態の導入前に登録された質問はQuestionOkから判断する
+func questionStatus(question Question) string {
+	if question.Status != "" {
+		return question.Status
+	}
+	if question.QuestionOk {
+		return QuestionStatusAnswered
+	}
+	return QuestionStatusOpen
+}
+
+func getQuestion(db *gorm.DB, questionId int) (bool, Question) {
+	var question Question
+	if err := db.First(&question, "question_id = ?", questionId).Error; err != nil {
+		fmt.Printf("Error: 質問が非存在: %d in getQuestion\n", questionId)
+		return false, Question{}
+	}
+	return true, question
+}
+
+func newQuestionStatusResult(meetingId int, question Question) QuestionStatusResult {
+	mergedInto := -1
+	if question.MergedInto != 0 {
+		mergedInto = question.MergedInto
+	}
+	return QuestionStatusResult{
+		MessageType:  "question_status",
+		MeetingId:    meetingId,
+		QuestionId:   question.QuestionId,
+		Status:       questionStatus(question),
+		QuestionBody: question.QuestionBody,
+		VoteNum:      question.VoteNum,
+		MergedInto:   mergedInto,
+		ClusterId:    clusterIdOrNone(question),
+	}
+}
+
+// editQuestion は未回答の質問の本文を変更する
+func editQuestion(db *gorm.DB, questionId int, questionBody string) bool {
+	result := db.Model(&Question{}).Where("question_id = ? AND question_ok = ?", questionId, false).Update("question_body", questionBody)
+	if result.Error != nil || result.RowsAffected != 1 {
+		fmt.Printf("Error: update失敗(質問が回答済みか，本文の更新に失敗しました): %d in editQuestion\n", questionId)
+		return false
+	}
+	fmt.Printf("Log: update成功(質問の本文を更新しました): %d in editQuestion\n", questionId)
+	return true
+}
+
+// closeQuestion は未回答の質問をstatusにする．既に未回答でない場合はfalseを返す
+func closeQuestion(db *gorm.DB, questionId int, status string) bool {
+	result := db.Model(&Question{}).Where("question_id = ? AND question_ok = ?", questionId, false).Updates(map[string]interface{}{
+		"status":      status,
+		"question_ok": true,
+	})
+	if result.Error != nil || result.RowsAffected != 1 {
+		fmt.Printf("Error: update失敗(質問が回答済みか，状態の更新に失敗しました): %d, %s in closeQuestion\n", questionId, status)
+		return false
+	}
+	fmt.Printf("Log: update成功(質問の状態を更新しました): %d, %s in closeQuestion\n", questionId, status)
+	return true
+}
+
+// mergeQuestion は未回答の質問sourceIdを同じ資料の未回答の質問targetIdに統合する．
+// sourceIdへの投票はtargetIdに移し(両方に投票していた参加者は1票)，targetIdの投票数を返す．
+// 投票数には参加者ごとの記録の導入前の分も含むため，両方の投票数の合計から重複した分を引く
+func mergeQuestion(db *gorm.DB, sourceId int, targetId int) (bool, int) {
+	var (
+		source Question
+		target Question
+		votes  = make([]QuestionVote, 0, 10)
+	)
+	if sourceId == targetId {
+		return false, -1
+	}
+	tx := db.Begin()
+	if err := tx.First(&source, "question_id = ? AND question_ok = ? AND is_voice = ?", sourceId, false, false).Error; err != nil {
+		tx.Rollback()
+		fmt.Printf("Error: 統合元の質問が非存在か回答済みです: %d in mergeQuestion\n", sourceId)
+		return false, -1
+	}
+	if err := tx.First(&target, "question_id = ? AND question_ok = ? AND is_voice = ?", targetId, false, false).Error; err != nil || target.DocumentId != source.DocumentId {
+		tx.Rollback()
+		fmt.Printf("Error: 統合先の質問が非存在か回答済みか，別の資料への質問です: %d in mergeQuestion\n", targetId)
+		return false, -1
+	}
+
+	tx.Find(&votes, "question_id = ?", sourceId)
+	duplicates := 0
+	for _, vote := range votes {
+		if err := tx.First(&QuestionVote{}, "question_id = ? AND user_id = ?", targetId, vote.UserId).Error; err == nil {
+			duplicates += 1
+			continue
+		}
+		if err := tx.Create(&QuestionVote{QuestionId: targetId, UserId: vote.UserId}).Error; err != nil {
+			tx.Rollback()
+			fmt.Printf("Error: create失敗(投票の移動に失敗しました): %d, %s in mergeQuestion\n", targetId, vote.UserId)
+			return false, -1
+		}
+	}
+	if err := tx.Where("question_id = ?", sourceId).Delete(&QuestionVote{}).Error; err != nil {
+		tx.Rollback()
+		fmt.Printf("Error: delete失敗(投票の移動に失敗しました): %d in mergeQuestion\n", sourceId)
+		return false, -1
+	}
+
+	voteNum := target.VoteNum + source.VoteNum - duplicates
+	if err := tx.Model(&Question{}).Where("question_id = ?", targetId).Update("vote_num", voteNum).Error; err != nil {
+		tx.Rollback()
+		fmt.Printf("Error: update失敗(統合先の投票数の更新に失敗しました): %d in mergeQuestion\n", targetId)
+		return false, -1
+	}
+	if err := tx.Model(&Question{}).Where("question_id = ?", sourceId).Updates(map[string]interface{}{
+		"status":      QuestionStatusMerged,
+		"question_ok": true,
+		"merged_into": targetId,
+		"vote_num":    0,
+	}).Error; err != nil {
+		tx.Rollback()
+		fmt.Printf("Error: update失敗(統合元の状態の更新に失敗しました): %d in mergeQuestion\n", sourceId)
+		return false, -1
+	}
+	if err := tx.Commit().Error; err != nil {
+		fmt.Printf("Error: commit失敗(質問の統合に失敗しました): %d, %d in mergeQuestion\n", sourceId, targetId)
+		return false, -1
+	}
+	fmt.Printf("Log: update成功(質問を統合しました): %d -> %d (%d票) in mergeQuestion\n", sourceId, targetId, voteNum)
+	return true, voteNum
+}
+
+// getPendingQuestions は会議の承認待ちの質問を投稿順に返す
+func getPendingQuestions(db *gorm.DB, meetingId int) []Question {
+	questions := make([]Question, 0, 10)
+	if err := db.Table("questions").Select("questions.*").Joins("inner join documents on documents.document_id = questions.document_id").Where("documents.meeting_id = ? AND questions.status = ?", meetingId, QuestionStatusPending).Order("questions.question_time, questions.question_id").Scan(&questions).Error; err != nil {
+		fmt.Printf("Error: 承認待ちの質問の取得に失敗しました: %d in getPendingQuestions\n", meetingId)
+	}
+	return questions
+}
+
+// getPendingQuestionResults は会議の承認待ちの質問を通知と同じ形式で返す
+func getPendingQuestionResults(db *gorm.DB, meetingId int) []QuestionResult {
+	setting := getMeetingSetting(db, meetingId)
+	results := make([]QuestionResult, 0, 10)
+	for _, question := range getPendingQuestions(db, meetingId) {
+		result := newQuestionResult(meetingId, question, setting)
+		result.MessageType = "question_pending"
+		results = append(results, result)
+	}
+	return results
+}
+
+// approveQuestion は承認待ちの質問を公開し，質問の候補にする
+func approveQuestion(db *gorm.DB, questionId int) bool {
+	result := db.Model(&Question{}).Where("question_id = ? AND status = ?", questionId, QuestionStatusPending).Updates(map[string]interface{}{
+		"status":      QuestionStatusOpen,
+		"question_ok": false,
+	})
+	if result.Error != nil || result.RowsAffected != 1 {
+		fmt.Printf("Error: update失敗(質問が承認待ちでないか，承認に失敗しました): %d in approveQuestion\n", questionId)
+		return false
+	}
+	fmt.Printf("Log: update成功(質問を承認しました): %d in approveQuestion\n", questionId)
+	return true
+}
+
+// closePendingQuestion は承認待ちの質問を公開せずにstatus(取り下げ)にする
+func closePendingQuestion(db *gorm.DB, questionId int, status string) bool {
+	result := db.Model(&Question{}).Where("question_id = ? AND status = ?", questionId, QuestionStatusPending).Update("status", status)
+	if result.Error != nil || result.RowsAffected != 1 {
+		fmt.Printf("Error: update失敗(質問が承認待ちでないか，取り下げに失敗しました): %d, %s in closePendingQuestion\n", questionId, status)
+		return false
+	}
+	fmt.Printf("Log: update成功(承認待ちの質問を取り下げました): %d, %s in closePendingQuestion\n", questionId, status)
+	return true
+}
+
+// resubmitQuestion は未回答か承認待ちの質問の本文を変更し，再び承認されるまで公開しない
+func resubmitQuestion(db *gorm.DB, questionId int, questionBody string) bool {
+	result := db.Model(&Question{}).Where("question_id = ? AND (question_ok = ? OR status = ?)", questionId, false, QuestionStatusPending).Updates(map[string]interface{}{
+		"question_body": questionBody,
+		"status":        QuestionStatusPending,
+		"question_ok":   true,
+	})
+	if result.Error != nil || result.RowsAffected != 1 {
+		fmt.Printf("Error: update失敗(質問が回答済みか，本文の更新に失敗しました): %d in resubmitQuestion\n", questionId)
+		return false
+	}
+	fmt.Printf("Log: update成功(質問の本文を更新し，承認待ちに戻しました): %d in resubmitQuestion\n", questionId)
+	return true
+}
+
+// canModerateQuestion は質問を回答済みにしたり取り下げたりできるかを返す．
+// 質問先の発表者本人，主催者，共同司会者のみ可能．
+func canModerateQuestion(db *gorm.DB, meetingId int, userId string, question Question) bool {
+	return canFinishPresen(db, meetingId, userId, getPresenterId(db, question.DocumentId))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 会議の参加者の役割
+const (
+	RoleOrganizer = "organizer" // 会議の主催者
+	RolePresenter = "presenter" // 発表者
+	RoleAudience  = "audience"  // 聴講者
+	RoleModerator = "moderator" // 人間の共同司会者
+)
+
+// isAssignableRole は/meeting/roleで割り当てられる役割かどうかを返す．
+// 発表者は発表順(ParticipantOrder)で決まるため割り当て対象外．
+func isAssignableRole(role string) bool {
+	return role == RoleOrganizer || role == RoleAudience || role == RoleModerator
+}
+
+// getParticipantRole は会議における参加者の役割を返す
+func getParticipantRole(db *gorm.DB, meetingId int, userId string) (bool, string) {
+	var participant Participant
+	if err := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, userId).Error; err != nil {
+		fmt.Printf("Log: 参加者が非存在: %d, %s in getParticipantRole\n", meetingId, userId)
+		return false, ""
+	}
+	return true, participantRole(participant)
+}
+
+func participantRole(participant Participant) string {
+	if participant.Role != "" {
+		return participant.Role
+	}
+	// 役割の導入前に登録された参加者は発表順から判断する
+	if participant.ParticipantOrder != -1 {
+		return RolePresenter
+	}
+	return RoleAudience
+}
+
+// backfillParticipantRoles は役割の導入前に登録された参加者に役割を設定する．
+// 発表順のある参加者は発表者，それ以外は聴講者とし，主催者のいない会議は最初の発表者を主催者とする
+// (会議の作成者は記録されていないため)．
+func backfillParticipantRoles(db *gorm.DB) {
+	if err := db.Model(&Participant{}).Where("participant_order != ? AND (role IS NULL OR role IN (?))", -1, []string{"", RoleAudience}).Update("role", RolePresenter).Error; err != nil {
+		fmt.Printf("Error: update失敗(発表者の役割の設定に失敗しました) in backfillParticipantRoles\n")
+	}
+	if err := db.Model(&Participant{}).Where("role IS NULL OR role = ?", "").Update("role", RoleAudience).Error; err != nil {
+		fmt.Printf("Error: update失敗(聴講者の役割の設定に失敗しました) in backfillParticipantRoles\n")
+	}
+	// MySQLでは更新するテーブルを副問い合わせで直接参照できないため，導出テーブルを挟む
+	if err := db.Exec("UPDATE participants SET role = ? WHERE participant_order = ? AND meeting_id NOT IN (SELECT meeting_id FROM (SELECT meeting_id FROM participants WHERE role = ?) AS organizers)", RoleOrganizer, 0, RoleOrganizer).Error; err != nil {
+		fmt.Printf("Error: update失敗(主催者の役割の設定に失敗しました) in backfillParticipantRoles\n")
+	}
+}
+
+// hasRole は参加者の役割がrolesのいずれかであるかを返す
+func hasRole(db *gorm.DB, meetingId int, userId string, roles ...string) bool {
+	isParticipant, role := getParticipantRole(db, meetingId, userId)
+	if !isParticipant {
+		return false
+	}
+	for _, r := range roles {
+		if role == r {
+			return true
+		}
+	}
+	fmt.Printf("Log: 権限がありません: %d, %s, %s in hasRole\n", meetingId, userId, role)
+	return false
+}
+
+// isPresenter は参加者が会議の発表者(発表順を持つ参加者)かどうかを返す
+func isPresenter(db *gorm.DB, meetingId int, userId string) bool {
+	var participant Participant
+	if err := db.First(&participant, "meeting_id = ? AND user_id = ?", meetingId, userId).Error; err != nil {
+		return false
+	}
+	return participant.ParticipantOrder != -1
+}
+
+// canFinishPresen は発表や質問の終了を指示できるかを返す．
+// 発表者本人，主催者，共同司会者のみ可能．
+func canFinishPresen(db *gorm.DB, meetingId int, userId string, presenterId string) bool {
+	if !isPresenter(db, meetingId, presenterId) {
+		fmt.Printf("Log: 発表者ではありません: %d, %s in canFinishPresen\n", meetingId, presenterId)
+		return false
+	}
+	return userId == presenterId || hasRole(db, meetingId, userId, RoleOrganizer, RoleModerator)
+}
+
+func setParticipantRole(db *gorm.DB, meetingId int, userId string, role string) bool {
+	if !isParticipant(db, meetingId, userId) {
+		return false
+	}
+	if err := db.Model(&Participant{}).Where("meeting_id = ? AND user_id = ?", meetingId, userId).Update("role", role).Error; err != nil {
+		fmt.Printf("Error: update失敗(参加者の役割の更新に失敗しました): %d, %s, %s in setParticipantRole\n", meetingId, userId, role)
+		return false
+	}
+	fmt.Printf("Log: update成功(参加者の役割を更新しました): %d, %s, %s in setParticipantRole\n", meetingId, userId, role)
+	return true
+}
+
+// getModeratorUserIds は会議の主催者と共同司会者のユーザーIDを返す
+func getModeratorUserIds(db *gorm.DB, meetingId int) []string {
+	participants := make([]Participant, 0, 10)
+	userIds := make([]string, 0, 10)
+	if err := db.Find(&participants, "meeting_id = ? AND role IN (?)", meetingId, []string{RoleOrganizer, RoleModerator}).Error; err != nil {
+		fmt.Printf("Error: 参加者の取得に失敗しました: %d in getModeratorUserIds\n", meetingId)
+	}
+	for _, participant := range participants {
+		userIds = append(userIds, participant.UserId)
+	}
+	return userIds
+}
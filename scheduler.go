@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// missedStartWindow は停止中に開始時刻を過ぎた会議について，起動時に開始通知を送る猶予．
+// これより前に開始時刻を過ぎた会議は通知しない．
+const missedStartWindow = 1 * time.Hour
+
+// Clock は現在時刻の取得とタイマーの生成を抽象化する．
+// テストでは任意の時刻を返し，手動でタイマーを発火させる実装に差し替える．
+// AfterFuncのfはtime.AfterFuncと同様に別のゴルーチンで呼び出すこと．
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer はClock.AfterFuncで生成したタイマー
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Scheduler は会議の開始時刻にfireを呼び出す．
+// 予約はDBのMeetingから起動時に読み込み直すため，再起動しても失われない．
+// 複数のノードで動かす場合，開始時刻の変更は変更を受け付けたノードの予約にしか反映されないため，
+// 発火時にstartTimeで現在の開始時刻を確かめ，まだ先であれば予約し直す．
+type Scheduler struct {
+	mu        sync.Mutex
+	clock     Clock
+	timers    map[int]Timer // meetingId -> 開始通知のタイマー
+	startTime func(meetingId int) (bool, time.Time)
+	fire      func(meetingId int)
+}
+
+func newScheduler(clock Clock, startTime func(meetingId int) (bool, time.Time), fire func(meetingId int)) *Scheduler {
+	return &Scheduler{
+		clock:     clock,
+		timers:    make(map[int]Timer),
+		startTime: startTime,
+		fire:      fire,
+	}
+}
+
+// schedule はmeetingIdの開始通知をstartTimeに予約する．既に予約されていれば予約し直す．
+func (s *Scheduler) schedule(meetingId int, startTime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timer, ok := s.timers[meetingId]; ok {
+		timer.Stop()
+		fmt.Printf("Log: 開始通知を予約し直します: %d in schedule\n", meetingId)
+	}
+
+	var timer Timer
+	timer = s.clock.AfterFunc(startTime.Sub(s.clock.Now()), func() {
+		s.mu.Lock()
+		// 発火前に予約し直された場合は古いタイマーなので何もしない
+		if s.timers[meetingId] != timer {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.timers, meetingId)
+		s.mu.Unlock()
+
+		// 他のノードで開始時刻が後ろにずらされていれば，その時刻に予約し直す
+		if ok, current := s.startTime(meetingId); ok && current.After(s.clock.Now()) {
+			fmt.Printf("Log: 開始時刻が変更されています: %d, %s in schedule\n", meetingId, current)
+			s.schedule(meetingId, current)
+			return
+		}
+		s.fire(meetingId)
+	})
+	s.timers[meetingId] = timer
+	fmt.Printf("Log: 開始通知を予約しました: %d, %s in schedule\n", meetingId, startTime)
+}
+
+// cancel はmeetingIdの開始通知の予約を取り消す
+func (s *Scheduler) cancel(meetingId int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timer, ok := s.timers[meetingId]; ok {
+		timer.Stop()
+		delete(s.timers, meetingId)
+		fmt.Printf("Log: 開始通知の予約を取り消しました: %d in cancel\n", meetingId)
+	}
+}
+
+// loadPending はまだ開始していない会議をDBから読み込み，開始通知を予約する
+func (s *Scheduler) loadPending(db *gorm.DB) {
+	s.schedulePending(getPendingMeetings(db))
+}
+
+// schedulePending はまだ開始していない会議の開始通知を予約する．
+// 停止中に開始時刻を過ぎた会議はmissedStartWindow以内であればすぐに通知する．
+func (s *Scheduler) schedulePending(meetings []Meeting) {
+	now := s.clock.Now()
+	for _, meeting := range meetings {
+		if meeting.MeetingStartTime.Before(now.Add(-missedStartWindow)) {
+			fmt.Printf("Log: 開始時刻を大きく過ぎているため通知しません: %d, %s in schedulePending\n", meeting.MeetingId, meeting.MeetingStartTime)
+			continue
+		}
+		s.schedule(meeting.MeetingId, meeting.MeetingStartTime)
+	}
+}
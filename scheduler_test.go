@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock は手動で時刻を進めるClock．Advanceで時刻を過ぎたタイマーを発火させる
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Advance は時刻をd進め，その時刻までのタイマーを時刻順に発火させる
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	due := make([]*fakeTimer, 0, len(c.timers))
+	rest := make([]*fakeTimer, 0, len(c.timers))
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if t.at.After(c.now) {
+			rest = append(rest, t)
+			continue
+		}
+		t.stopped = true
+		due = append(due, t)
+	}
+	c.timers = rest
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// firedRecorder はSchedulerから通知された会議IDを記録する
+type firedRecorder struct {
+	mu    sync.Mutex
+	fired []int
+}
+
+func (r *firedRecorder) fire(meetingId int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fired = append(r.fired, meetingId)
+}
+
+func (r *firedRecorder) ids() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int{}, r.fired...)
+}
+
+// fakeStartTimes はDBの代わりに会議の開始時刻を保持する
+type fakeStartTimes struct {
+	mu    sync.Mutex
+	times map[int]time.Time
+}
+
+func newFakeStartTimes(times map[int]time.Time) *fakeStartTimes {
+	return &fakeStartTimes{times: times}
+}
+
+func (f *fakeStartTimes) startTime(meetingId int) (bool, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	startTime, ok := f.times[meetingId]
+	return ok, startTime
+}
+
+func (f *fakeStartTimes) set(meetingId int, startTime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.times[meetingId] = startTime
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSchedulerSchedulePending(t *testing.T) {
+	now := time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		startTime time.Time
+		advance   time.Duration
+		want      []int
+	}{
+		{"開始時刻に通知する", now.Add(30 * time.Minute), 30 * time.Minute, []int{1}},
+		{"開始時刻の前は通知しない", now.Add(30 * time.Minute), 29 * time.Minute, []int{}},
+		{"停止中に少し過ぎた会議はすぐに通知する", now.Add(-30 * time.Minute), 0, []int{1}},
+		{"停止中に大きく過ぎた会議は通知しない", now.Add(-2 * time.Hour), 3 * time.Hour, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock(now)
+			recorder := &firedRecorder{}
+			startTimes := newFakeStartTimes(map[int]time.Time{1: tt.startTime})
+			scheduler := newScheduler(clock, startTimes.startTime, recorder.fire)
+
+			scheduler.schedulePending([]Meeting{{MeetingId: 1, MeetingStartTime: tt.startTime}})
+			clock.Advance(tt.advance)
+
+			if got := recorder.ids(); !equalInts(got, tt.want) {
+				t.Errorf("通知された会議 = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	now := time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+	clock := newFakeClock(now)
+	recorder := &firedRecorder{}
+	startTimes := newFakeStartTimes(map[int]time.Time{1: now.Add(20 * time.Minute)})
+	scheduler := newScheduler(clock, startTimes.startTime, recorder.fire)
+
+	scheduler.schedule(1, now.Add(10*time.Minute))
+	scheduler.schedule(1, now.Add(20*time.Minute))
+
+	clock.Advance(15 * time.Minute)
+	if got := recorder.ids(); len(got) != 0 {
+		t.Fatalf("予約し直す前の開始時刻に通知されました: %v", got)
+	}
+	clock.Advance(5 * time.Minute)
+	if got := recorder.ids(); !equalInts(got, []int{1}) {
+		t.Fatalf("通知された会議 = %v, want [1]", got)
+	}
+	if _, ok := scheduler.timers[1]; ok {
+		t.Errorf("通知後も予約が残っています")
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	now := time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+	clock := newFakeClock(now)
+	recorder := &firedRecorder{}
+	startTimes := newFakeStartTimes(map[int]time.Time{1: now.Add(10 * time.Minute), 2: now.Add(10 * time.Minute)})
+	scheduler := newScheduler(clock, startTimes.startTime, recorder.fire)
+
+	scheduler.schedule(1, now.Add(10*time.Minute))
+	scheduler.schedule(2, now.Add(10*time.Minute))
+	scheduler.cancel(1)
+	clock.Advance(10 * time.Minute)
+
+	if got := recorder.ids(); !equalInts(got, []int{2}) {
+		t.Errorf("通知された会議 = %v, want [2]", got)
+	}
+	if _, ok := scheduler.timers[1]; ok {
+		t.Errorf("取り消した予約が残っています")
+	}
+}
+
+func TestSchedulerStartTimeChangedOnOtherNode(t *testing.T) {
+	now := time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+	clock := newFakeClock(now)
+	recorder := &firedRecorder{}
+	startTimes := newFakeStartTimes(map[int]time.Time{1: now.Add(10 * time.Minute)})
+	scheduler := newScheduler(clock, startTimes.startTime, recorder.fire)
+
+	scheduler.schedule(1, now.Add(10*time.Minute))
+	// 他のノードが開始時刻を変更し，このノードの予約は古いまま
+	startTimes.set(1, now.Add(30*time.Minute))
+
+	clock.Advance(10 * time.Minute)
+	if got := recorder.ids(); len(got) != 0 {
+		t.Fatalf("変更前の開始時刻に通知されました: %v", got)
+	}
+	if _, ok := scheduler.timers[1]; !ok {
+		t.Fatalf("変更後の開始時刻に予約し直されていません")
+	}
+	clock.Advance(20 * time.Minute)
+	if got := recorder.ids(); !equalInts(got, []int{1}) {
+		t.Errorf("通知された会議 = %v, want [1]", got)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 不在の発表者を最後に回す猶予の既定値(秒)
+const defaultAbsentPresenterGraceSec = 300
+
+// MeetingSetting は会議ごとの司会進行の設定
+type MeetingSetting struct {
+	MeetingId                int     `gorm:"primary_key;auto_increment:false"`
+	MaxQuestionNum           int     // 発表者ごとの質問数
+	ReactionThresholdRatio   float64 // 参加者数に対するリアクション数の割合がこれ以上なら説明を促す
+	ColdCallEnabled          bool    // 質問がない時に発言の少ない参加者を当てるか
+	AnonymousQuestionAllowed bool    // 質問を匿名で読み上げるか(falseの場合は質問者の名前を読み上げる)
+	PresentDurationSec       int     // 発表1件の制限時間(秒)．0の場合は制限しない
+	QuestionDurationSec      int     // 発表者1人分の質疑応答の制限時間(秒)．0の場合は制限しない
+	QuestionStrategy         string  // 質問者の選び方(strategy.goのStrategy*)．空の場合は既定の選び方
+	QuestionApprovalRequired bool    // 投稿された質問を主催者か共同司会者が承認するまで公開しないか
+	// 退出してからこの秒数内の発表者は，順番が来た時に飛ばさずに一度だけ最後に回す(再接続中の可能性が高いため)．
+	// 0の場合は不在の発表者を常に飛ばす．0を保存できるようポインタにし，導入前の会議は既定値とする
+	AbsentPresenterGraceSec *int `gorm:"default:300"`
+}
+
+// MeetingSettingRequest は会議の設定の変更内容．省略した項目は変更しない．
+type MeetingSettingRequest struct {
+	MaxQuestionNum           *int     `json:"maxQuestionNum"`
+	ReactionThresholdRatio   *float64 `json:"reactionThresholdRatio"`
+	ColdCallEnabled          *bool    `json:"coldCallEnabled"`
+	AnonymousQuestionAllowed *bool    `json:"anonymousQuestionAllowed"`
+	PresentDurationSec       *int     `json:"presentDurationSec"`
+	QuestionDurationSec      *int     `json:"questionDurationSec"`
+	QuestionStrategy         *string  `json:"questionStrategy"`
+	QuestionApprovalRequired *bool    `json:"questionApprovalRequired"`
+	AbsentPresenterGraceSec  *int     `json:"absentPresenterGraceSec"`
+}
+
+// MeetingSettingResult は会議の設定を返す，もしくは設定の変更を参加者に通知するメッセージ
+type MeetingSettingResult struct {
+	MessageType              string  `json:"messageType"`
+	MeetingId                int     `json:"meetingId"`
+	MaxQuestionNum           int     `json:"maxQuestionNum"`
+	ReactionThresholdRatio   float64 `json:"reactionThresholdRatio"`
+	ColdCallEnabled          bool    `json:"coldCallEnabled"`
+	AnonymousQuestionAllowed bool    `json:"anonymousQuestionAllowed"`
+	PresentDurationSec       int     `json:"presentDurationSec"`
+	QuestionDurationSec      int     `json:"questionDurationSec"`
+	QuestionStrategy         string  `json:"questionStrategy"`
+	QuestionApprovalRequired bool    `json:"questionApprovalRequired"`
+	AbsentPresenterGraceSec  int     `json:"absentPresenterGraceSec"`
+}
+
+func defaultMeetingSetting(meetingId int) MeetingSetting {
+	absentPresenterGraceSec := defaultAbsentPresenterGraceSec
+	return MeetingSetting{
+		MeetingId:                meetingId,
+		MaxQuestionNum:           5,
+		ReactionThresholdRatio:   0.5,
+		ColdCallEnabled:          true,
+		AnonymousQuestionAllowed: true,
+		PresentDurationSec:       0,
+		QuestionDurationSec:      0,
+		QuestionStrategy:         StrategyDefault,
+		QuestionApprovalRequired: false,
+		AbsentPresenterGraceSec:  &absentPresenterGraceSec,
+	}
+}
+
+// getAbsentPresenterGraceSec は不在の発表者を最後に回す猶予(秒)を返す
+func getAbsentPresenterGraceSec(setting MeetingSetting) int {
+	if setting.AbsentPresenterGraceSec == nil {
+		return defaultAbsentPresenterGraceSec
+	}
+	return *setting.AbsentPresenterGraceSec
+}
+
+// getAbsentPresenterGrace は不在の発表者を最後に回す猶予を返す
+func getAbsentPresenterGrace(setting MeetingSetting) time.Duration {
+	return time.Duration(getAbsentPresenterGraceSec(setting)) * time.Second
+}
+
+// apply はrequestで指定された項目をsettingに反映する．値が不正な場合はfalseを返す．
+func (request *MeetingSettingRequest) apply(setting *MeetingSetting) bool {
+	if request == nil {
+		return true
+	}
+	if request.MaxQuestionNum != nil {
+		if *request.MaxQuestionNum < 0 {
+			return false
+		}
+		setting.MaxQuestionNum = *request.MaxQuestionNum
+	}
+	if request.ReactionThresholdRatio != nil {
+		if *request.ReactionThresholdRatio < 0 || *request.ReactionThresholdRatio > 1 {
+			return false
+		}
+		setting.ReactionThresholdRatio = *request.ReactionThresholdRatio
+	}
+	if request.ColdCallEnabled != nil {
+		setting.ColdCallEnabled = *request.ColdCallEnabled
+	}
+	if request.AnonymousQuestionAllowed != nil {
+		setting.AnonymousQuestionAllowed = *request.AnonymousQuestionAllowed
+	}
+	if request.PresentDurationSec != nil {
+		if *request.PresentDurationSec < 0 {
+			return false
+		}
+		setting.PresentDurationSec = *request.PresentDurationSec
+	}
+	if request.QuestionDurationSec != nil {
+		if *request.QuestionDurationSec < 0 {
+			return false
+		}
+		setting.QuestionDurationSec = *request.QuestionDurationSec
+	}
+	if request.QuestionStrategy != nil {
+		if !isQuestionStrategy(*request.QuestionStrategy) {
+			return false
+		}
+		setting.QuestionStrategy = *request.QuestionStrategy
+	}
+	if request.QuestionApprovalRequired != nil {
+		setting.QuestionApprovalRequired = *request.QuestionApprovalRequired
+	}
+	if request.AbsentPresenterGraceSec != nil {
+		if *request.AbsentPresenterGraceSec < 0 {
+			return false
+		}
+		absentPresenterGraceSec := *request.AbsentPresenterGraceSec
+		setting.AbsentPresenterGraceSec = &absentPresenterGraceSec
+	}
+	return true
+}
+
+func newMeetingSettingResult(setting MeetingSetting) MeetingSettingResult {
+	return MeetingSettingResult{
+		MessageType:              "setting_update",
+		MeetingId:                setting.MeetingId,
+		MaxQuestionNum:           setting.MaxQuestionNum,
+		ReactionThresholdRatio:   setting.ReactionThresholdRatio,
+		ColdCallEnabled:          setting.ColdCallEnabled,
+		AnonymousQuestionAllowed: setting.AnonymousQuestionAllowed,
+		PresentDurationSec:       setting.PresentDurationSec,
+		QuestionDurationSec:      setting.QuestionDurationSec,
+		QuestionStrategy:         getQuestionStrategyName(setting.QuestionStrategy),
+		QuestionApprovalRequired: setting.QuestionApprovalRequired,
+		AbsentPresenterGraceSec:  getAbsentPresenterGraceSec(setting),
+	}
+}
+
+// getMeetingSetting は会議の設定を返す．設定の導入前に作成された会議には既定の設定を返す．
+func getMeetingSetting(db *gorm.DB, meetingId int) MeetingSetting {
+	var setting MeetingSetting
+	if err := db.First(&setting, "meeting_id = ?", meetingId).Error; err != nil {
+		return defaultMeetingSetting(meetingId)
+	}
+	return setting
+}
+
+// updateMeetingSetting は会議の設定にrequestを反映して保存する
+func updateMeetingSetting(db *gorm.DB, meetingId int, request *MeetingSettingRequest) (bool, MeetingSetting) {
+	setting := getMeetingSetting(db, meetingId)
+	if !request.apply(&setting) {
+		fmt.Printf("Error: 設定の値が不正です: %d in updateMeetingSetting\n", meetingId)
+		return false, setting
+	}
+	if err := db.Save(&setting).Error; err != nil {
+		fmt.Printf("Error: update失敗(会議の設定の保存に失敗しました): %d in updateMeetingSetting\n", meetingId)
+		return false, setting
+	}
+	fmt.Printf("Log: update成功(会議の設定を保存しました): %+v in updateMeetingSetting\n", setting)
+	return true, setting
+}
+
+// sendMeetingSetting は変更後の会議の設定を参加者に通知する
+func (hub *Hub) sendMeetingSetting(setting MeetingSetting) {
+	hub.broadcastToRoom(setting.MeetingId, newMeetingSettingResult(setting))
+	fmt.Printf("Log: 設定変更通知を送信しました: %d in sendMeetingSetting\n", setting.MeetingId)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 会議の状態
+const (
+	MeetingStateScheduled  = "scheduled"  // 開始前
+	MeetingStateStarted    = "started"    // 開始済み(最初の発表前)
+	MeetingStatePresenting = "presenting" // 発表中
+	MeetingStateQuestion   = "question"   // 質疑応答中
+	MeetingStateBreak      = "break"      // 休憩中
+	MeetingStateEnded      = "ended"      // 終了
+)
+
+// meetingStateTransitions は各状態から遷移できる状態
+var meetingStateTransitions = map[string][]string{
+	MeetingStateScheduled:  {MeetingStateStarted},
+	MeetingStateStarted:    {MeetingStatePresenting, MeetingStateEnded},
+	MeetingStatePresenting: {MeetingStatePresenting, MeetingStateQuestion, MeetingStateBreak, MeetingStateEnded},
+	MeetingStateQuestion:   {MeetingStatePresenting, MeetingStateQuestion, MeetingStateBreak, MeetingStateEnded},
+	MeetingStateBreak:      {MeetingStatePresenting, MeetingStateQuestion, MeetingStateEnded},
+	MeetingStateEnded:      {},
+}
+
+// MeetingState は会議の進行状態．
+// presentingでは発表順PresentOrderの発表者PresenterIdが発表中，
+// questionではその発表者のQuestionNum件目の質疑応答中であることを表す．
+type MeetingState struct {
+	MeetingId      int    `gorm:"primary_key;auto_increment:false"`
+	State          string `gorm:"not null"`
+	PresentOrder   int    `gorm:"not null;default:-1"`
+	PresenterId    string
+	QuestionNum    int `gorm:"not null;default:0"`
+	QuestionUserId string
+	Version        int `gorm:"not null;default:0"` // 更新のたびに増やし，同時更新を防ぐ
+	UpdatedAt      time.Time
+	// 制限時間は再起動時に戻せるよう保存する(Versionは増やさない)
+	PhaseEndTime *time.Time // 発表もしくは質疑応答の制限時間が切れる時刻．制限時間がない場合はnil
+	PausedSec    int        `gorm:"not null;default:0"` // 休憩で止めた制限時間の残り(秒)
+}
+
+// MeetingStateResult は会議の状態を返す，もしくは状態の変化を参加者に通知するメッセージ
+type MeetingStateResult struct {
+	MessageType    string `json:"messageType"`
+	MeetingId      int    `json:"meetingId"`
+	State          string `json:"state"`
+	PresentOrder   int    `json:"presentOrder"`
+	PresenterId    string `json:"presenterId"`
+	QuestionNum    int    `json:"questionNum"`
+	QuestionUserId string `json:"questionUserId"`
+	Version        int    `json:"version"`
+}
+
+func newMeetingStateResult(state MeetingState) MeetingStateResult {
+	return MeetingStateResult{
+		MessageType:    "meeting_state",
+		MeetingId:      state.MeetingId,
+		State:          state.State,
+		PresentOrder:   state.PresentOrder,
+		PresenterId:    state.PresenterId,
+		QuestionNum:    state.QuestionNum,
+		QuestionUserId: state.QuestionUserId,
+		Version:        state.Version,
+	}
+}
+
+func canTransitMeetingState(from string, to string) bool {
+	for _, state := range meetingStateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// getMeetingState は会議の現在の状態を返す．
+// 状態が未保存の会議は，終了済みならended，そうでなければscheduledとする．
+func getMeetingState(db *gorm.DB, meetingId int) MeetingState {
+	var state MeetingState
+	if err := db.First(&state, "meeting_id = ?", meetingId).Error; err == nil {
+		return state
+	}
+	state = MeetingState{
+		MeetingId:    meetingId,
+		State:        MeetingStateScheduled,
+		PresentOrder: -1,
+		Version:      0,
+	}
+	if ok, meeting := getMeeting(db, meetingId); ok && meeting.MeetingDone {
+		state.State = MeetingStateEnded
+	}
+	return state
+}
+
+// transitMeetingState は会議の状態をnextに遷移させる．
+// 不正な遷移や，中止された会議，他で先に状態が更新された場合はfalseと現在の状態を返す．
+// endedに遷移した場合は会議を終了済みにする．
+func transitMeetingState(db *gorm.DB, meetingId int, next MeetingState) (bool, MeetingState) {
+	current := getMeetingState(db, meetingId)
+	if !canTransitMeetingState(current.State, next.State) {
+		fmt.Printf("Error: 不正な状態遷移です: %d, %s -> %s in transitMeetingState\n", meetingId, current.State, next.State)
+		return false, current
+	}
+	if ok, meeting := getMeeting(db, meetingId); !ok || meeting.MeetingCanceled {
+		fmt.Printf("Error: 会議が非存在か中止済みです: %d in transitMeetingState\n", meetingId)
+		return false, current
+	}
+
+	next.MeetingId = meetingId
+	next.Version = current.Version + 1
+	if current.Version == 0 {
+		// 状態が未保存の場合は作成する(同時に作成された場合は主キーの重複で失敗する)
+		if err := db.Create(&next).Error; err != nil {
+			fmt.Printf("Error: insert失敗(会議の状態の作成に失敗しました): %d, %s in transitMeetingState\n", meetingId, next.State)
+			return false, getMeetingState(db, meetingId)
+		}
+	} else {
+		result := db.Model(&MeetingState{}).Where("meeting_id = ? AND version = ?", meetingId, current.Version).Updates(map[string]interface{}{
+			"state":            next.State,
+			"present_order":    next.PresentOrder,
+			"presenter_id":     next.PresenterId,
+			"question_num":     next.QuestionNum,
+			"question_user_id": next.QuestionUserId,
+			"version":          next.Version,
+		})
+		if result.Error != nil || result.RowsAffected != 1 {
+			fmt.Printf("Error: update失敗(会議の状態が先に更新されたか，更新に失敗しました): %d, %s in transitMeetingState\n", meetingId, next.State)
+			return false, getMeetingState(db, meetingId)
+		}
+	}
+
+	if next.State == MeetingStateEnded {
+		if err := db.Model(&Meeting{}).Where("meeting_id = ?", meetingId).Update("meeting_done", true).Error; err != nil {
+			fmt.Printf("Error: update失敗(会議の終了状態の更新に失敗しました): %d in transitMeetingState\n", meetingId)
+		}
+	}
+	fmt.Printf("Log: 会議の状態を更新しました: %d, %s -> %s (%d) in transitMeetingState\n", meetingId, current.State, next.State, next.Version)
+	return true, getMeetingState(db, meetingId)
+}
+
+// saveMeetingPhase は現在のフェーズの制限時間が切れる時刻と，休憩で止めた残り時間を保存する
+func saveMeetingPhase(db *gorm.DB, meetingId int, endTime *time.Time, pausedSec int) bool {
+	if err := db.Model(&MeetingState{}).Where("meeting_id = ?", meetingId).Updates(map[string]interface{}{
+		"phase_end_time": endTime,
+		"paused_sec":     pausedSec,
+	}).Error; err != nil {
+		fmt.Printf("Error: update失敗(制限時間の保存に失敗しました): %d in saveMeetingPhase\n", meetingId)
+		return false
+	}
+	return true
+}
+
+// getProgressingMeetingStates は進行中(発表中，質疑応答中，休憩中)の会議の状態を返す
+func getProgressingMeetingStates(db *gorm.DB) []MeetingState {
+	states := make([]MeetingState, 0, 10)
+	if err := db.Table("meeting_states").Select("meeting_states.*").Joins("inner join meetings on meetings.meeting_id = meeting_states.meeting_id").Where("meetings.meeting_done = ? AND meetings.meeting_canceled = ? AND meeting_states.state IN (?)", false, false, []string{MeetingStatePresenting, MeetingStateQuestion, MeetingStateBreak}).Scan(&states).Error; err != nil {
+		fmt.Printf("Error: 会議の状態の取得に失敗しました in getProgressingMeetingStates\n")
+	}
+	return states
+}
+
+// sendMeetingState は会議の状態の変化を参加者に通知する
+func (hub *Hub) sendMeetingState(state MeetingState) {
+	hub.broadcastToRoom(state.MeetingId, newMeetingStateResult(state))
+	fmt.Printf("Log: 会議の状態を通知しました: %d, %s in sendMeetingState\n", state.MeetingId, state.State)
+}
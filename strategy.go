@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 質問者の選び方(MeetingSetting.QuestionStrategy)
+const (
+	StrategyDefault        = "default"         // 挙手，投票の多い質問，リアクションの多いページの説明，発言の少ない参加者の順
+	StrategyRoundRobin     = "round_robin"     // 既定と同じだが，参加者を当てる時はユーザーID順に順番に当てる
+	StrategyWeightedRandom = "weighted_random" // 既定と同じだが，参加者を当てる時は発言の少ない人ほど当たりやすいランダム
+	StrategyFifoHands      = "fifo_hands"      // 挙手の待ち行列の順に当てるのみ
+	StrategyVotesOnly      = "votes_only"      // 投票の多い質問を読み上げるのみ
+	StrategyNoColdCalls    = "no_cold_calls"   // 既定と同じだが，参加者を当てない
+)
+
+// 選ばれた質問の種類
+const (
+	PickNone       = iota // 質問も当てる参加者もいない
+	PickHand              // 挙手した参加者を当てる
+	PickQuestion          // 投稿された質問を読み上げる
+	PickSuggestion        // リアクションの多いページの説明を促す
+	PickColdCall          // 参加者を当てる
+)
+
+// QuestionCandidates は質問者を選ぶ時の候補
+type QuestionCandidates struct {
+	Hands          []Question    // 挙手中の参加者(待ち行列の順)
+	Questions      []Question    // 未回答の投稿された質問
+	Reactions      []Reaction    // 説明を促していないページのリアクション
+	Participants   []Participant // 当てられる参加者(発表者と直前の質問者を除く，在席中の参加者)
+	QuestionUserId string        // 直前の質問者
+	Setting        MeetingSetting
+	Intn           func(n int) int // [0, n)の乱数
+}
+
+// QuestionPick は選ばれた質問
+type QuestionPick struct {
+	Kind        int
+	Question    Question
+	Reaction    Reaction
+	Participant Participant
+}
+
+// QuestionStrategy は候補から次の質問を選ぶ
+type QuestionStrategy interface {
+	pick(candidates QuestionCandidates) QuestionPick
+}
+
+// QuestionStore は質問者の選択に必要な読み書き．DBを使わずに選び方を確かめられるよう差し替えられる
+type QuestionStore interface {
+	candidates(meetingId int, documentId int, presenterId string, questionUserId string) QuestionCandidates
+	// apply は選ばれた質問を回答済みにして発言数を増やし，必要なら質問を作成して，その質問IDを返す
+	apply(meetingId int, documentId int, pick QuestionPick) (bool, int)
+}
+
+// priorityStrategy は挙手，投稿された質問，ページの説明，参加者を当てるの順に，使うものから選ぶ
+type priorityStrategy struct {
+	useHands      bool
+	useQuestions  bool
+	useSuggestion bool
+	coldCall      func(candidates QuestionCandidates) Participant // nilの場合は参加者を当てない
+}
+
+var questionStrategies = map[string]QuestionStrategy{
+	StrategyDefault:        priorityStrategy{useHands: true, useQuestions: true, useSuggestion: true, coldCall: lowestSpeakNum},
+	StrategyRoundRobin:     priorityStrategy{useHands: true, useQuestions: true, useSuggestion: true, coldCall: roundRobin},
+	StrategyWeightedRandom: priorityStrategy{useHands: true, useQuestions: true, useSuggestion: true, coldCall: weightedRandom},
+	StrategyFifoHands:      priorityStrategy{useHands: true},
+	StrategyVotesOnly:      priorityStrategy{useQuestions: true},
+	StrategyNoColdCalls:    priorityStrategy{useHands: true, useQuestions: true, useSuggestion: true},
+}
+
+func isQuestionStrategy(name string) bool {
+	_, ok := questionStrategies[name]
+	return ok
+}
+
+// getQuestionStrategy は名前に対応する選び方を返す．未設定の場合は既定の選び方を返す
+func getQuestionStrategy(name string) QuestionStrategy {
+	return questionStrategies[getQuestionStrategyName(name)]
+}
+
+// getQuestionStrategyName は設定された選び方の名前を返す．未設定の場合は既定の選び方の名前を返す
+func getQuestionStrategyName(name string) string {
+	if isQuestionStrategy(name) {
+		return name
+	}
+	return StrategyDefault
+}
+
+func (s priorityStrategy) pick(c QuestionCandidates) QuestionPick {
+	if s.useHands && len(c.Hands) != 0 {
+		return QuestionPick{Kind: PickHand, Question: c.Hands[0]}
+	}
+	if s.useQuestions && len(c.Questions) != 0 {
+		// 似た質問のまとまりの投票数の合計が多い順に，まとまりの中では投票の多い質問を選ぶ
+		questions := append([]Question{}, c.Questions...)
+		voteNums := clusterVoteNums(questions)
+		sort.SliceStable(questions, func(i, j int) bool {
+			vi, vj := voteNums[questionClusterId(questions[i])], voteNums[questionClusterId(questions[j])]
+			if vi != vj {
+				return vi > vj
+			}
+			return questions[i].VoteNum > questions[j].VoteNum
+		})
+		return QuestionPick{Kind: PickQuestion, Question: questions[0]}
+	}
+	if len(c.Participants) == 0 {
+		return QuestionPick{Kind: PickNone}
+	}
+	if s.useSuggestion && len(c.Reactions) != 0 {
+		reactions := append([]Reaction{}, c.Reactions...)
+		sort.Stable(ReverseByReactionNum(reactions))
+		if reactions[0].ReactionNum >= int(c.Setting.ReactionThresholdRatio*float64(len(c.Participants))) {
+			return QuestionPick{Kind: PickSuggestion, Reaction: reactions[0]}
+		}
+	}
+	if s.coldCall == nil || !c.Setting.ColdCallEnabled {
+		return QuestionPick{Kind: PickNone}
+	}
+	return QuestionPick{Kind: PickColdCall, Participant: s.coldCall(c)}
+}
+
+// lowestSpeakNum は最も発言の少ない参加者を当てる
+func lowestSpeakNum(c QuestionCandidates) Participant {
+	participants := append([]Participant{}, c.Participants...)
+	sort.Stable(BySpeakNum(participants))
+	return participants[0]
+}
+
+// roundRobin はユーザーID順で直前の質問者の次の参加者を当てる
+func roundRobin(c QuestionCandidates) Participant {
+	participants := append([]Participant{}, c.Participants...)
+	sort.SliceStable(participants, func(i, j int) bool { return participants[i].UserId < participants[j].UserId })
+	for _, participant := range participants {
+		if participant.UserId > c.QuestionUserId {
+			return participant
+		}
+	}
+	return participants[0]
+}
+
+// weightedRandom は発言数+1の逆数に比例した確率で参加者を当てる
+func weightedRandom(c QuestionCandidates) Participant {
+	// 重みを整数で扱うため，最大の発言数+1を基準にする
+	maxSpeakNum := 0
+	for _, participant := range c.Participants {
+		if participant.SpeakNum > maxSpeakNum {
+			maxSpeakNum = participant.SpeakNum
+		}
+	}
+	weights := make([]int, len(c.Participants))
+	total := 0
+	for i, participant := range c.Participants {
+		weights[i] = (maxSpeakNum + 1) * 100 / (participant.SpeakNum + 1)
+		total += weights[i]
+	}
+	r := c.Intn(total)
+	for i, weight := range weights {
+		if r < weight {
+			return c.Participants[i]
+		}
+		r -= weight
+	}
+	return c.Participants[len(c.Participants)-1]
+}
+
+// gormQuestionStore はDBを使うQuestionStore
+type gormQuestionStore struct {
+	db *gorm.DB
+}
+
+func (s gormQuestionStore) candidates(meetingId int, documentId int, presenterId string, questionUserId string) QuestionCandidates {
+	c := QuestionCandidates{
+		Hands:          make([]Question, 0, 10),
+		Questions:      make([]Question, 0, 10),
+		Reactions:      make([]Reaction, 0, 10),
+		Participants:   make([]Participant, 0, 10),
+		QuestionUserId: questionUserId,
+		Setting:        getMeetingSetting(s.db, meetingId),
+		Intn:           rand.New(rand.NewSource(time.Now().UnixNano())).Intn,
+	}
+	c.Hands = getHandQueue(s.db, documentId)
+	s.db.Order("question_time, question_id").Find(&c.Questions, "document_id = ? AND question_ok = ? AND is_voice = ?", documentId, false, false)
+	s.db.Find(&c.Reactions, "document_id = ? AND suggestion_ok = ?", documentId, false)
+	s.db.Find(&c.Participants, "meeting_id = ? AND user_id != ? AND user_id != ? AND is_joining = ?", meetingId, presenterId, questionUserId, true)
+	return c
+}
+
+func (s gormQuestionStore) apply(meetingId int, documentId int, pick QuestionPick) (bool, int) {
+	location, _ := time.LoadLocation("Asia/Tokyo")
+
+	switch pick.Kind {
+	case PickHand, PickQuestion:
+		question := pick.Question
+		// 似た質問のまとまりはまとめて回答済みにする
+		query := s.db.Model(&Question{}).Where("question_id = ?", question.QuestionId)
+		if question.ClusterId != 0 {
+			query = s.db.Model(&Question{}).Where("question_id = ? OR ((cluster_id = ? OR question_id = ?) AND question_ok = ?)", question.QuestionId, question.ClusterId, question.ClusterId, false)
+		}
+		if err := query.Updates(map[string]interface{}{
+			"status":      QuestionStatusAnswered,
+			"question_ok": true,
+		}).Error; err != nil {
+			fmt.Printf("Error: update失敗(質問の回答状況の更新に失敗しました): %d in apply\n", question.QuestionId)
+			return false, -1
+		}
+		if !s.incrementSpeakNum(meetingId, question.UserId) {
+			return false, -1
+		}
+		return true, question.QuestionId
+	case PickSuggestion:
+		reaction := pick.Reaction
+		if err := s.db.Model(&Reaction{}).Where("document_id = ? AND document_page = ?", reaction.DocumentId, reaction.DocumentPage).Update("suggestion_ok", true).Error; err != nil {
+			fmt.Printf("Error: update失敗(資料リアクションの提案状況の更新に失敗しました): %d, %d in apply\n", reaction.DocumentId, reaction.DocumentPage)
+			return false, -1
+		}
+		return s.create(Question{
+			UserId:       "Moderator",
+			QuestionBody: fmt.Sprintf("%dページについての詳しい説明を要求．", reaction.DocumentPage),
+			DocumentId:   reaction.DocumentId,
+			DocumentPage: reaction.DocumentPage,
+			VoteNum:      reaction.ReactionNum,
+			QuestionTime: time.Now().In(location),
+			QuestionOk:   true,
+			Status:       QuestionStatusAnswered,
+			IsVoice:      false,
+		})
+	case PickColdCall:
+		ok, questionId := s.create(Question{
+			UserId:       pick.Participant.UserId,
+			QuestionBody: "",
+			DocumentId:   documentId,
+			DocumentPage: 1,
+			VoteNum:      0,
+			QuestionTime: time.Now().In(location),
+			QuestionOk:   true,
+			Status:       QuestionStatusAnswered,
+			IsVoice:      true,
+		})
+		if !ok || !s.incrementSpeakNum(meetingId, pick.Participant.UserId) {
+			return false, -1
+		}
+		return true, questionId
+	}
+	return false, -1
+}
+
+func (s gormQuestionStore) create(question Question) (bool, int) {
+	if err := s.db.Create(&question).Error; err != nil {
+		fmt.Printf("Error: create失敗(質問の登録に失敗しました): %s, %d, %s in create\n", question.UserId, question.DocumentId, question.QuestionTime)
+		return false, -1
+	}
+	fmt.Printf("Log: create成功(質問の登録に成功しました): %s, %d, %s in create\n", question.UserId, question.DocumentId, question.QuestionTime)
+	return true, question.QuestionId
+}
+
+func (s gormQuestionStore) incrementSpeakNum(meetingId int, userId string) bool {
+	if err := s.db.Model(&Participant{}).Where("meeting_id = ? AND user_id = ?", meetingId, userId).Update("speak_num", gorm.Expr("speak_num + ?", 1)).Error; err != nil {
+		fmt.Printf("Error: update失敗(参加者の話数の更新に失敗しました): %s, %d in incrementSpeakNum\n", userId, meetingId)
+		return false
+	}
+	return true
+}
+
+// pickQuestion は会議の設定の選び方で次の質問を選ぶ．storeへの書き込みは行わない
+func pickQuestion(store QuestionStore, meetingId int, documentId int, presenterId string, questionUserId string) QuestionPick {
+	candidates := store.candidates(meetingId, documentId, presenterId, questionUserId)
+	pick := getQuestionStrategy(candidates.Setting.QuestionStrategy).pick(candidates)
+	if pick.Kind == PickNone {
+		fmt.Printf("Log: 質問も当てる参加者もいません: %d in pickQuestion\n", meetingId)
+	}
+	return pick
+}
+
+// pickUserId は選ばれた質問で当てる参加者を返す．参加者を当てない場合は空
+func pickUserId(pick QuestionPick) string {
+	switch pick.Kind {
+	case PickHand:
+		return pick.Question.UserId
+	case PickColdCall:
+		return pick.Participant.UserId
+	}
+	return ""
+}
+
+// applyQuestionPick は選ばれた質問をstoreに反映する．返り値は(参加者を当てるか, ページの説明を促すか, 当てる参加者, 質問ID)で，
+// 質問も当てる参加者もいない場合や反映に失敗した場合の質問IDは-1
+func applyQuestionPick(store QuestionStore, meetingId int, documentId int, pick QuestionPick) (bool, bool, string, int) {
+	if pick.Kind == PickNone {
+		return false, false, "", -1
+	}
+	ok, questionId := store.apply(meetingId, documentId, pick)
+	if !ok {
+		return false, false, "", -1
+	}
+	switch pick.Kind {
+	case PickHand:
+		return true, false, pick.Question.UserId, questionId
+	case PickQuestion:
+		return false, false, "", questionId
+	case PickSuggestion:
+		return false, true, "", questionId
+	default:
+		return true, false, pick.Participant.UserId, questionId
+	}
+}
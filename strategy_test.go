@@ -0,0 +1,425 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeQuestionStore はDBの代わりにメモリ上の質問，リアクション，参加者を使うQuestionStore
+type fakeQuestionStore struct {
+	questions    []Question
+	reactions    []Reaction
+	participants []Participant
+	setting      MeetingSetting
+	intn         func(n int) int
+	failApply    bool
+}
+
+func (s *fakeQuestionStore) candidates(meetingId int, documentId int, presenterId string, questionUserId string) QuestionCandidates {
+	c := QuestionCandidates{
+		Hands:          make([]Question, 0, 10),
+		Questions:      make([]Question, 0, 10),
+		Reactions:      make([]Reaction, 0, 10),
+		Participants:   make([]Participant, 0, 10),
+		QuestionUserId: questionUserId,
+		Setting:        s.setting,
+		Intn:           s.intn,
+	}
+	// gormQuestionStoreと同じ条件と並び順で候補を集める
+	for _, question := range s.questions {
+		if question.DocumentId != documentId || question.QuestionOk {
+			continue
+		}
+		if question.IsVoice {
+			c.Hands = append(c.Hands, question)
+		} else {
+			c.Questions = append(c.Questions, question)
+		}
+	}
+	sort.SliceStable(c.Hands, func(i, j int) bool {
+		if c.Hands[i].QueuePosition != c.Hands[j].QueuePosition {
+			return c.Hands[i].QueuePosition < c.Hands[j].QueuePosition
+		}
+		return byQuestionTimeAndId(c.Hands[i], c.Hands[j])
+	})
+	sort.SliceStable(c.Questions, func(i, j int) bool { return byQuestionTimeAndId(c.Questions[i], c.Questions[j]) })
+	for _, reaction := range s.reactions {
+		if reaction.DocumentId == documentId && !reaction.SuggestionOk {
+			c.Reactions = append(c.Reactions, reaction)
+		}
+	}
+	for _, participant := range s.participants {
+		if participant.MeetingId == meetingId && participant.UserId != presenterId && participant.UserId != questionUserId && participant.IsJoining {
+			c.Participants = append(c.Participants, participant)
+		}
+	}
+	return c
+}
+
+func byQuestionTimeAndId(a Question, b Question) bool {
+	if !a.QuestionTime.Equal(b.QuestionTime) {
+		return a.QuestionTime.Before(b.QuestionTime)
+	}
+	return a.QuestionId < b.QuestionId
+}
+
+func (s *fakeQuestionStore) apply(meetingId int, documentId int, pick QuestionPick) (bool, int) {
+	if s.failApply {
+		return false, -1
+	}
+	switch pick.Kind {
+	case PickHand, PickQuestion:
+		question := pick.Question
+		for i := range s.questions {
+			q := &s.questions[i]
+			sameCluster := question.ClusterId != 0 && (q.ClusterId == question.ClusterId || q.QuestionId == question.ClusterId) && !q.QuestionOk
+			if q.QuestionId == question.QuestionId || sameCluster {
+				q.Status = QuestionStatusAnswered
+				q.QuestionOk = true
+			}
+		}
+		s.incrementSpeakNum(meetingId, question.UserId)
+		return true, question.QuestionId
+	case PickSuggestion:
+		for i := range s.reactions {
+			if s.reactions[i].DocumentId == pick.Reaction.DocumentId && s.reactions[i].DocumentPage == pick.Reaction.DocumentPage {
+				s.reactions[i].SuggestionOk = true
+			}
+		}
+		return true, s.create(Question{UserId: "Moderator", DocumentId: pick.Reaction.DocumentId, DocumentPage: pick.Reaction.DocumentPage, QuestionOk: true, Status: QuestionStatusAnswered})
+	case PickColdCall:
+		s.incrementSpeakNum(meetingId, pick.Participant.UserId)
+		return true, s.create(Question{UserId: pick.Participant.UserId, DocumentId: documentId, DocumentPage: 1, QuestionOk: true, Status: QuestionStatusAnswered, IsVoice: true})
+	}
+	return false, -1
+}
+
+func (s *fakeQuestionStore) create(question Question) int {
+	question.QuestionId = len(s.questions) + 100
+	s.questions = append(s.questions, question)
+	return question.QuestionId
+}
+
+func (s *fakeQuestionStore) incrementSpeakNum(meetingId int, userId string) {
+	for i := range s.participants {
+		if s.participants[i].MeetingId == meetingId && s.participants[i].UserId == userId {
+			s.participants[i].SpeakNum++
+		}
+	}
+}
+
+func (s *fakeQuestionStore) speakNum(userId string) int {
+	for _, participant := range s.participants {
+		if participant.UserId == userId {
+			return participant.SpeakNum
+		}
+	}
+	return -1
+}
+
+func (s *fakeQuestionStore) question(questionId int) Question {
+	for _, question := range s.questions {
+		if question.QuestionId == questionId {
+			return question
+		}
+	}
+	return Question{}
+}
+
+const (
+	testMeetingId   = 1
+	testDocumentId  = 10
+	testPresenterId = "presenter"
+)
+
+var testQuestionTime = time.Date(2021, 8, 1, 10, 0, 0, 0, time.UTC)
+
+func hand(questionId int, userId string, queuePosition int, minute int) Question {
+	return Question{QuestionId: questionId, UserId: userId, DocumentId: testDocumentId, QuestionTime: testQuestionTime.Add(time.Duration(minute) * time.Minute), IsVoice: true, QueuePosition: queuePosition, Status: QuestionStatusOpen}
+}
+
+func posted(questionId int, voteNum int, clusterId int, minute int) Question {
+	return Question{QuestionId: questionId, UserId: "poster", DocumentId: testDocumentId, QuestionTime: testQuestionTime.Add(time.Duration(minute) * time.Minute), VoteNum: voteNum, ClusterId: clusterId, Status: QuestionStatusOpen}
+}
+
+func answered(question Question) Question {
+	question.QuestionOk = true
+	question.Status = QuestionStatusAnswered
+	return question
+}
+
+// testParticipants は発表者，在席中のa(発言2回)，b(1回)，c(1回)，退出したd(0回)
+func testParticipants() []Participant {
+	return []Participant{
+		{MeetingId: testMeetingId, UserId: testPresenterId, IsJoining: true},
+		{MeetingId: testMeetingId, UserId: "a", SpeakNum: 2, IsJoining: true},
+		{MeetingId: testMeetingId, UserId: "b", SpeakNum: 1, IsJoining: true},
+		{MeetingId: testMeetingId, UserId: "c", SpeakNum: 1, IsJoining: true},
+		{MeetingId: testMeetingId, UserId: "d", SpeakNum: 0, IsJoining: false},
+	}
+}
+
+func fixedIntn(r int) func(n int) int {
+	return func(n int) int {
+		if r < 0 {
+			return n + r
+		}
+		return r
+	}
+}
+
+func TestPickQuestion(t *testing.T) {
+	tests := []struct {
+		name           string
+		strategy       string
+		coldCall       bool
+		intn           func(n int) int
+		questions      []Question
+		reactions      []Reaction
+		participants   []Participant
+		questionUserId string
+		wantKind       int
+		wantQuestionId int    // PickHand, PickQuestionの場合
+		wantUserId     string // PickColdCallの場合
+		wantPage       int    // PickSuggestionの場合
+	}{
+		// 既定の選び方
+		{name: "既定: 挙手を待ち行列の順に当てる", strategy: StrategyDefault,
+			questions: []Question{hand(1, "a", 2, 0), hand(2, "b", 1, 1), posted(3, 5, 0, 0)},
+			wantKind:  PickHand, wantQuestionId: 2},
+		{name: "既定: 待ち行列の順が同じ挙手は先に挙げた方", strategy: StrategyDefault,
+			questions: []Question{hand(1, "a", 0, 1), hand(2, "b", 0, 0)},
+			wantKind:  PickHand, wantQuestionId: 2},
+		{name: "既定: 回答済みの挙手は当てない", strategy: StrategyDefault,
+			questions: []Question{answered(hand(1, "a", 0, 0)), posted(2, 0, 0, 0)},
+			wantKind:  PickQuestion, wantQuestionId: 2},
+		{name: "既定: 投票の多い質問", strategy: StrategyDefault,
+			questions: []Question{posted(1, 2, 0, 0), posted(2, 3, 0, 1)},
+			wantKind:  PickQuestion, wantQuestionId: 2},
+		{name: "既定: 投票数が同じ質問は先に投稿された方", strategy: StrategyDefault,
+			questions: []Question{posted(2, 3, 0, 1), posted(1, 3, 0, 0)},
+			wantKind:  PickQuestion, wantQuestionId: 1},
+		{name: "既定: 回答済みの質問は選ばない", strategy: StrategyDefault,
+			questions: []Question{answered(posted(1, 10, 0, 0)), posted(2, 1, 0, 1)},
+			wantKind:  PickQuestion, wantQuestionId: 2},
+		{name: "既定: まとまりの投票数の合計で選ぶ", strategy: StrategyDefault,
+			questions: []Question{posted(1, 2, 1, 0), posted(2, 3, 0, 1), posted(3, 2, 1, 2)},
+			wantKind:  PickQuestion, wantQuestionId: 1},
+		{name: "既定: 参加者がいない場合は選ばない", strategy: StrategyDefault, coldCall: true,
+			reactions:    []Reaction{{DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 5}},
+			participants: []Participant{{MeetingId: testMeetingId, UserId: testPresenterId, IsJoining: true}},
+			wantKind:     PickNone},
+		{name: "既定: 候補が空の場合は選ばない", strategy: StrategyDefault,
+			participants: []Participant{},
+			wantKind:     PickNone},
+		{name: "既定: リアクションの多いページの説明を促す", strategy: StrategyDefault, coldCall: true,
+			reactions: []Reaction{{DocumentId: testDocumentId, DocumentPage: 2, ReactionNum: 1}, {DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 2}},
+			wantKind:  PickSuggestion, wantPage: 3},
+		{name: "既定: 説明を促したページは選ばない", strategy: StrategyDefault,
+			reactions: []Reaction{{DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 2, SuggestionOk: true}},
+			wantKind:  PickNone},
+		{name: "既定: 発言の少ない参加者を当てる", strategy: StrategyDefault, coldCall: true,
+			wantKind: PickColdCall, wantUserId: "b"},
+		{name: "既定: 参加者を当てる設定でなければ当てない", strategy: StrategyDefault,
+			wantKind: PickNone},
+		{name: "未設定の場合は既定の選び方", strategy: "", coldCall: true,
+			wantKind: PickColdCall, wantUserId: "b"},
+
+		// ユーザーID順
+		{name: "ユーザーID順: 直前の質問者の次", strategy: StrategyRoundRobin, coldCall: true, questionUserId: "a",
+			wantKind: PickColdCall, wantUserId: "b"},
+		{name: "ユーザーID順: 最後の次は最初に戻る", strategy: StrategyRoundRobin, coldCall: true, questionUserId: "c",
+			wantKind: PickColdCall, wantUserId: "a"},
+		{name: "ユーザーID順: 挙手を優先する", strategy: StrategyRoundRobin, coldCall: true,
+			questions: []Question{hand(1, "c", 0, 0)},
+			wantKind:  PickHand, wantQuestionId: 1},
+
+		// 重み付きランダム(重みはa=100, b=150, c=150)
+		{name: "重み付きランダム: 最初の参加者", strategy: StrategyWeightedRandom, coldCall: true, intn: fixedIntn(0),
+			wantKind: PickColdCall, wantUserId: "a"},
+		{name: "重み付きランダム: 重みの境界", strategy: StrategyWeightedRandom, coldCall: true, intn: fixedIntn(100),
+			wantKind: PickColdCall, wantUserId: "b"},
+		{name: "重み付きランダム: 最後の参加者", strategy: StrategyWeightedRandom, coldCall: true, intn: fixedIntn(-1),
+			wantKind: PickColdCall, wantUserId: "c"},
+		{name: "重み付きランダム: 投票の多い質問を優先する", strategy: StrategyWeightedRandom, coldCall: true, intn: fixedIntn(0),
+			questions: []Question{posted(1, 1, 0, 0)},
+			wantKind:  PickQuestion, wantQuestionId: 1},
+
+		// 挙手のみ
+		{name: "挙手のみ: 挙手を当てる", strategy: StrategyFifoHands, coldCall: true,
+			questions: []Question{posted(1, 5, 0, 0), hand(2, "a", 0, 1)},
+			wantKind:  PickHand, wantQuestionId: 2},
+		{name: "挙手のみ: 投稿された質問は選ばない", strategy: StrategyFifoHands, coldCall: true,
+			questions: []Question{posted(1, 5, 0, 0)},
+			reactions: []Reaction{{DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 5}},
+			wantKind:  PickNone},
+
+		// 投票のみ
+		{name: "投票のみ: 投票の多い質問", strategy: StrategyVotesOnly, coldCall: true,
+			questions: []Question{hand(1, "a", 0, 0), posted(2, 1, 0, 1), posted(3, 2, 0, 2)},
+			wantKind:  PickQuestion, wantQuestionId: 3},
+		{name: "投票のみ: 質問がなければ当てない", strategy: StrategyVotesOnly, coldCall: true,
+			questions: []Question{hand(1, "a", 0, 0)},
+			reactions: []Reaction{{DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 5}},
+			wantKind:  PickNone},
+
+		// 参加者を当てない
+		{name: "当てない: ページの説明を促す", strategy: StrategyNoColdCalls, coldCall: true,
+			reactions: []Reaction{{DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 5}},
+			wantKind:  PickSuggestion, wantPage: 3},
+		{name: "当てない: 参加者を当てる設定でも当てない", strategy: StrategyNoColdCalls, coldCall: true,
+			wantKind: PickNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeQuestionStore{
+				questions:    tt.questions,
+				reactions:    tt.reactions,
+				participants: tt.participants,
+				setting:      MeetingSetting{MeetingId: testMeetingId, QuestionStrategy: tt.strategy, ColdCallEnabled: tt.coldCall, ReactionThresholdRatio: 0.5},
+				intn:         tt.intn,
+			}
+			if store.participants == nil {
+				store.participants = testParticipants()
+			}
+
+			pick := pickQuestion(store, testMeetingId, testDocumentId, testPresenterId, tt.questionUserId)
+
+			if pick.Kind != tt.wantKind {
+				t.Fatalf("種類 = %d, want %d (%+v)", pick.Kind, tt.wantKind, pick)
+			}
+			switch pick.Kind {
+			case PickHand, PickQuestion:
+				if pick.Question.QuestionId != tt.wantQuestionId {
+					t.Errorf("質問ID = %d, want %d", pick.Question.QuestionId, tt.wantQuestionId)
+				}
+			case PickColdCall:
+				if pick.Participant.UserId != tt.wantUserId {
+					t.Errorf("当てる参加者 = %s, want %s", pick.Participant.UserId, tt.wantUserId)
+				}
+			case PickSuggestion:
+				if pick.Reaction.DocumentPage != tt.wantPage {
+					t.Errorf("ページ = %d, want %d", pick.Reaction.DocumentPage, tt.wantPage)
+				}
+			}
+			// 選ぶだけではstoreに書き込まない
+			for i, question := range tt.questions {
+				if store.questions[i] != question {
+					t.Errorf("選ぶだけで質問が変更されました: %+v", store.questions[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyQuestionPick(t *testing.T) {
+	tests := []struct {
+		name               string
+		questions          []Question
+		reactions          []Reaction
+		pick               func(store *fakeQuestionStore) QuestionPick
+		failApply          bool
+		wantPickQuestioner bool
+		wantSuggest        bool
+		wantUserId         string
+		wantQuestionId     int
+		wantAnswered       []int
+		wantSpeakUserId    string
+	}{
+		{name: "挙手を当てる",
+			questions: []Question{hand(1, "a", 0, 0)},
+			pick: func(store *fakeQuestionStore) QuestionPick {
+				return QuestionPick{Kind: PickHand, Question: store.questions[0]}
+			},
+			wantPickQuestioner: true, wantUserId: "a", wantQuestionId: 1, wantAnswered: []int{1}, wantSpeakUserId: "a"},
+		{name: "似た質問のまとまりはまとめて回答済みにする",
+			questions: []Question{posted(1, 2, 1, 0), posted(2, 1, 1, 1), posted(3, 1, 0, 2)},
+			pick: func(store *fakeQuestionStore) QuestionPick {
+				return QuestionPick{Kind: PickQuestion, Question: store.questions[1]}
+			},
+			wantQuestionId: 2, wantAnswered: []int{1, 2}, wantSpeakUserId: "poster"},
+		{name: "ページの説明を促す",
+			reactions: []Reaction{{DocumentId: testDocumentId, DocumentPage: 3, ReactionNum: 5}},
+			pick: func(store *fakeQuestionStore) QuestionPick {
+				return QuestionPick{Kind: PickSuggestion, Reaction: store.reactions[0]}
+			},
+			wantSuggest: true, wantQuestionId: 100, wantAnswered: []int{100}},
+		{name: "参加者を当てる",
+			pick: func(store *fakeQuestionStore) QuestionPick {
+				return QuestionPick{Kind: PickColdCall, Participant: store.participants[2]}
+			},
+			wantPickQuestioner: true, wantUserId: "b", wantQuestionId: 100, wantAnswered: []int{100}, wantSpeakUserId: "b"},
+		{name: "選ばれていない場合は何もしない",
+			questions:      []Question{posted(1, 2, 0, 0)},
+			pick:           func(store *fakeQuestionStore) QuestionPick { return QuestionPick{Kind: PickNone} },
+			wantQuestionId: -1},
+		{name: "反映に失敗した場合は質問IDを-1にする",
+			questions: []Question{hand(1, "a", 0, 0)},
+			pick: func(store *fakeQuestionStore) QuestionPick {
+				return QuestionPick{Kind: PickHand, Question: store.questions[0]}
+			},
+			failApply:      true,
+			wantQuestionId: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeQuestionStore{
+				questions:    append([]Question{}, tt.questions...),
+				reactions:    append([]Reaction{}, tt.reactions...),
+				participants: testParticipants(),
+				setting:      MeetingSetting{MeetingId: testMeetingId},
+				failApply:    tt.failApply,
+			}
+			speakNums := map[string]int{}
+			for _, participant := range store.participants {
+				speakNums[participant.UserId] = participant.SpeakNum
+			}
+
+			pickQuestioner, suggest, userId, questionId := applyQuestionPick(store, testMeetingId, testDocumentId, tt.pick(store))
+
+			if pickQuestioner != tt.wantPickQuestioner || suggest != tt.wantSuggest || userId != tt.wantUserId || questionId != tt.wantQuestionId {
+				t.Errorf("applyQuestionPick = (%v, %v, %q, %d), want (%v, %v, %q, %d)",
+					pickQuestioner, suggest, userId, questionId, tt.wantPickQuestioner, tt.wantSuggest, tt.wantUserId, tt.wantQuestionId)
+			}
+			for _, id := range tt.wantAnswered {
+				if question := store.question(id); !question.QuestionOk || question.Status != QuestionStatusAnswered {
+					t.Errorf("質問%dが回答済みになっていません: %+v", id, question)
+				}
+			}
+			if tt.wantAnswered == nil {
+				for _, question := range store.questions {
+					if question.QuestionOk {
+						t.Errorf("質問%dが回答済みになりました", question.QuestionId)
+					}
+				}
+			}
+			for userId, before := range speakNums {
+				want := before
+				if userId == tt.wantSpeakUserId {
+					want++
+				}
+				if got := store.speakNum(userId); got != want {
+					t.Errorf("%sの発言数 = %d, want %d", userId, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickQuestionSkipsAnswered(t *testing.T) {
+	// 選んで反映した質問は次の候補にならない
+	store := &fakeQuestionStore{
+		questions:    []Question{posted(1, 3, 1, 0), posted(2, 2, 1, 1), posted(3, 1, 0, 2)},
+		participants: testParticipants(),
+		setting:      MeetingSetting{MeetingId: testMeetingId, QuestionStrategy: StrategyVotesOnly},
+	}
+	want := []int{1, 3, -1}
+	for i, wantId := range want {
+		pick := pickQuestion(store, testMeetingId, testDocumentId, testPresenterId, "")
+		_, _, _, questionId := applyQuestionPick(store, testMeetingId, testDocumentId, pick)
+		if questionId != wantId {
+			t.Errorf("%d回目の質問ID = %d, want %d", i+1, questionId, wantId)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SyncResult は会議の現在の状態をまとめて返すメッセージ．
+// 途中から参加した，もしくは再接続したクライアントが画面を復元するために使う．
+type SyncResult struct {
+	MessageType  string               `json:"messageType"`
+	MeetingId    int                  `json:"meetingId"`
+	State        MeetingStateResult   `json:"state"`
+	RemainingSec int                  `json:"remainingSec"` // 制限時間がない場合は-1
+	Setting      MeetingSettingResult `json:"setting"`
+	Participants []SyncParticipant    `json:"participants"`
+	Questions    []SyncQuestion       `json:"questions"`
+	Hands        []SyncHand           `json:"hands"`
+	Reactions    []SyncReaction       `json:"reactions"`
+	// 承認待ちの質問．主催者と共同司会者には全て，他の参加者には自分の質問のみ返す
+	PendingQuestions []QuestionResult `json:"pendingQuestions"`
+}
+
+type SyncParticipant struct {
+	UserId       string `json:"userId"`
+	UserName     string `json:"userName"`
+	Role         string `json:"role"`
+	PresentOrder int    `json:"presentOrder"`
+	IsJoining    bool   `json:"isJoining"`
+	DocumentId   int    `json:"documentId"`
+}
+
+// SyncQuestion は未回答の質問．匿名の質問が許可されている場合UserIdは空
+type SyncQuestion struct {
+	QuestionId   int    `json:"questionId"`
+	UserId       string `json:"userId"`
+	QuestionBody string `json:"questionBody"`
+	DocumentId   int    `json:"documentId"`
+	DocumentPage int    `json:"documentPage"`
+	VoteNum      int    `json:"voteNum"`
+	QuestionTime string `json:"questionTime"`
+	ClusterId    int    `json:"clusterId"` // 似た質問のまとまりのID．まとまりに属さない場合は-1
+}
+
+// SyncHand は挙手中の参加者．Handsは資料ごとに待ち行列の順に並ぶ
+type SyncHand struct {
+	UserId       string `json:"userId"`
+	Position     int    `json:"position"` // 資料ごとの待ち行列での順番(1から)
+	DocumentId   int    `json:"documentId"`
+	DocumentPage int    `json:"documentPage"`
+	QuestionTime string `json:"questionTime"`
+}
+
+type SyncReaction struct {
+	DocumentId   int `json:"documentId"`
+	DocumentPage int `json:"documentPage"`
+	ReactionNum  int `json:"reactionNum"`
+}
+
+// getSync は参加者，質問，挙手，リアクション，資料と進行状態から，userIdの参加者から見た会議の現在の状態を組み立てる
+func getSync(db *gorm.DB, hub *Hub, meetingId int, userId string) SyncResult {
+	var (
+		layout       = "2006/01/02 15:04:05"
+		location, _  = time.LoadLocation("Asia/Tokyo")
+		setting      = getMeetingSetting(db, meetingId)
+		participants = make([]Participant, 0, 10)
+		documents    = make([]Document, 0, 10)
+		questions    = make([]Question, 0, 10)
+		reactions    = make([]Reaction, 0, 10)
+		documentIds  = make(map[string]int)
+		result       = SyncResult{
+			MessageType:  "sync",
+			MeetingId:    meetingId,
+			State:        newMeetingStateResult(getMeetingState(db, meetingId)),
+			RemainingSec: hub.progress.remainingSec(meetingId),
+			Setting:      newMeetingSettingResult(setting),
+			Participants: make([]SyncParticipant, 0, 10),
+			Questions:    make([]SyncQuestion, 0, 10),
+			Hands:        make([]SyncHand, 0, 10),
+			Reactions:    make([]SyncReaction, 0, 10),
+
+			PendingQuestions: make([]QuestionResult, 0, 10),
+		}
+	)
+
+	if err := db.Find(&documents, "meeting_id = ?", meetingId).Error; err != nil {
+		fmt.Printf("Error: 資料の取得に失敗しました: %d in getSync\n", meetingId)
+	}
+	for _, document := range documents {
+		documentIds[document.UserId] = document.DocumentId
+	}
+
+	if err := db.Find(&participants, "meeting_id = ?", meetingId).Error; err != nil {
+		fmt.Printf("Error: 参加者の取得に失敗しました: %d in getSync\n", meetingId)
+	}
+	for _, participant := range participants {
+		documentId, ok := documentIds[participant.UserId]
+		if !ok {
+			documentId = -1
+		}
+		result.Participants = append(result.Participants, SyncParticipant{
+			UserId:       participant.UserId,
+			UserName:     getUserName(db, participant.UserId),
+			Role:         participantRole(participant),
+			PresentOrder: participant.ParticipantOrder,
+			IsJoining:    participant.IsJoining,
+			DocumentId:   documentId,
+		})
+	}
+
+	if err := db.Table("questions").Select("questions.*").Joins("inner join documents on documents.document_id = questions.document_id").Where("documents.meeting_id = ? AND questions.question_ok = ?", meetingId, false).Order("questions.document_id, questions.queue_position, questions.question_time, questions.question_id").Scan(&questions).Error; err != nil {
+		fmt.Printf("Error: 質問の取得に失敗しました: %d in getSync\n", meetingId)
+	}
+	positions := make(map[int]int)
+	for _, q := range questions {
+		questionTime := q.QuestionTime.In(location).Format(layout)
+		if q.IsVoice {
+			positions[q.DocumentId] += 1
+			result.Hands = append(result.Hands, SyncHand{
+				UserId:       q.UserId,
+				Position:     positions[q.DocumentId],
+				DocumentId:   q.DocumentId,
+				DocumentPage: q.DocumentPage,
+				QuestionTime: questionTime,
+			})
+			continue
+		}
+		questionUserId := q.UserId
+		if setting.AnonymousQuestionAllowed {
+			questionUserId = ""
+		}
+		result.Questions = append(result.Questions, SyncQuestion{
+			QuestionId:   q.QuestionId,
+			UserId:       questionUserId,
+			QuestionBody: q.QuestionBody,
+			DocumentId:   q.DocumentId,
+			DocumentPage: q.DocumentPage,
+			VoteNum:      q.VoteNum,
+			QuestionTime: questionTime,
+			ClusterId:    clusterIdOrNone(q),
+		})
+	}
+
+	if err := db.Table("reactions").Select("reactions.*").Joins("inner join documents on documents.document_id = reactions.document_id").Where("documents.meeting_id = ?", meetingId).Scan(&reactions).Error; err != nil {
+		fmt.Printf("Error: リアクションの取得に失敗しました: %d in getSync\n", meetingId)
+	}
+	for _, r := range reactions {
+		result.Reactions = append(result.Reactions, SyncReaction{
+			DocumentId:   r.DocumentId,
+			DocumentPage: r.DocumentPage,
+			ReactionNum:  r.ReactionNum,
+		})
+	}
+
+	isModerator := hasRole(db, meetingId, userId, RoleOrganizer, RoleModerator)
+	for _, q := range getPendingQuestions(db, meetingId) {
+		if !isModerator && q.UserId != userId {
+			continue
+		}
+		pending := newQuestionResult(meetingId, q, setting)
+		pending.MessageType = "question_pending"
+		result.PendingQuestions = append(result.PendingQuestions, pending)
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// QuestionVote は参加者1人の質問への投票．投票の登録と取り消しに合わせてQuestion.VoteNumを増減する
+type QuestionVote struct {
+	QuestionId int    `gorm:"primary_key;auto_increment:false"`
+	UserId     string `gorm:"primary_key"`
+	CreatedAt  time.Time
+}
+
+// ReactionVote は参加者1人の資料のページへのリアクション．リアクションの登録と取り消しに合わせてReaction.ReactionNumを増減する
+type ReactionVote struct {
+	DocumentId   int    `gorm:"primary_key;auto_increment:false"`
+	DocumentPage int    `gorm:"primary_key;auto_increment:false"`
+	UserId       string `gorm:"primary_key"`
+	CreatedAt    time.Time
+}
+
+// setQuestionVote はユーザーの質問への投票をisVoteの状態にし，投票数の増減(+1，-1，変化しない場合は0)を返す．
+// 同じ状態を何度指定しても結果は変わらない．
+// 投票数は参加者ごとの記録の導入前に数えた分を含むため，記録の件数から数え直さずにこの増減を足す．
+func setQuestionVote(db *gorm.DB, userId string, questionId int, isVote bool) (bool, int) {
+	vote := QuestionVote{QuestionId: questionId, UserId: userId}
+	if isVote {
+		if err := db.First(&QuestionVote{}, "question_id = ? AND user_id = ?", questionId, userId).Error; err == nil {
+			return true, 0
+		}
+		if err := db.Create(&vote).Error; err != nil {
+			// 同時に投票された場合は主キーの重複で失敗する
+			if db.First(&QuestionVote{}, "question_id = ? AND user_id = ?", questionId, userId).Error == nil {
+				return true, 0
+			}
+			fmt.Printf("Error: create失敗(質問への投票の登録に失敗しました): %d, %s in setQuestionVote\n", questionId, userId)
+			return false, 0
+		}
+		return true, 1
+	}
+	result := db.Where("question_id = ? AND user_id = ?", questionId, userId).Delete(&QuestionVote{})
+	if result.Error != nil {
+		fmt.Printf("Error: delete失敗(質問への投票の取り消しに失敗しました): %d, %s in setQuestionVote\n", questionId, userId)
+		return false, 0
+	}
+	return true, -int(result.RowsAffected)
+}
+
+// setReactionVote はユーザーの資料のページへのリアクションをisReactionの状態にし，リアクション数の増減(+1，-1，変化しない場合は0)を返す．
+// 同じ状態を何度指定しても結果は変わらない．
+func setReactionVote(db *gorm.DB, userId string, documentId int, documentPage int, isReaction bool) (bool, int) {
+	vote := ReactionVote{DocumentId: documentId, DocumentPage: documentPage, UserId: userId}
+	if isReaction {
+		if err := db.First(&ReactionVote{}, "document_id = ? AND document_page = ? AND user_id = ?", documentId, documentPage, userId).Error; err == nil {
+			return true, 0
+		}
+		if err := db.Create(&vote).Error; err != nil {
+			// 同時にリアクションされた場合は主キーの重複で失敗する
+			if db.First(&ReactionVote{}, "document_id = ? AND document_page = ? AND user_id = ?", documentId, documentPage, userId).Error == nil {
+				return true, 0
+			}
+			fmt.Printf("Error: create失敗(リアクションの登録に失敗しました): %d, %d, %s in setReactionVote\n", documentId, documentPage, userId)
+			return false, 0
+		}
+		return true, 1
+	}
+	result := db.Where("document_id = ? AND document_page = ? AND user_id = ?", documentId, documentPage, userId).Delete(&ReactionVote{})
+	if result.Error != nil {
+		fmt.Printf("Error: delete失敗(リアクションの取り消しに失敗しました): %d, %d, %s in setReactionVote\n", documentId, documentPage, userId)
+		return false, 0
+	}
+	return true, -int(result.RowsAffected)
+}
+
+// getMyVotes はユーザーが会議で投票した質問と，リアクションした資料のページを返す
+func getMyVotes(db *gorm.DB, meetingId int, userId string) ([]int, []int, []int) {
+	var (
+		questionVotes = make([]QuestionVote, 0, 10)
+		reactionVotes = make([]ReactionVote, 0, 10)
+		questionIds   = make([]int, 0, 10)
+		documentIds   = make([]int, 0, 10)
+		documentPages = make([]int, 0, 10)
+	)
+	if err := db.Table("question_votes").Select("question_votes.*").Joins("inner join questions on questions.question_id = question_votes.question_id").Joins("inner join documents on documents.document_id = questions.document_id").Where("documents.meeting_id = ? AND question_votes.user_id = ?", meetingId, userId).Scan(&questionVotes).Error; err != nil {
+		fmt.Printf("Error: 質問への投票の取得に失敗しました: %d, %s in getMyVotes\n", meetingId, userId)
+	}
+	for _, vote := range questionVotes {
+		questionIds = append(questionIds, vote.QuestionId)
+	}
+	if err := db.Table("reaction_votes").Select("reaction_votes.*").Joins("inner join documents on documents.document_id = reaction_votes.document_id").Where("documents.meeting_id = ? AND reaction_votes.user_id = ?", meetingId, userId).Scan(&reactionVotes).Error; err != nil {
+		fmt.Printf("Error: リアクションの取得に失敗しました: %d, %s in getMyVotes\n", meetingId, userId)
+	}
+	for _, vote := range reactionVotes {
+		documentIds = append(documentIds, vote.DocumentId)
+		documentPages = append(documentPages, vote.DocumentPage)
+	}
+	return questionIds, documentIds, documentPages
+}